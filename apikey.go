@@ -0,0 +1,336 @@
+package users
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API keys are formatted as apiKeyPrefix, followed by the hex encoded random
+// part of the prefix, a dot and the base64 encoded secret.
+const (
+	apiKeyPrefix    = "usk_" // makes keys recognisable, e.g. for secret scanners
+	apiKeyPrefixLen = 6      // length of the random part of the prefix in bytes
+	apiKeySecretLen = 32     // length of the secret in bytes
+)
+
+// APIKey holds the data of a personal API key, except for its secret. It's
+// identified by its prefix, which is the part of the key before the dot.
+type APIKey struct {
+	created  time.Time // time of creation
+	expires  time.Time // time the key expires, zero if it doesn't
+	groupIds []int     // groups the key is restricted to, empty if it isn't
+	hash     string    // hash of the secret
+	lastUsed time.Time // time of the last successful authentication
+	name     string    // name, unique for the user
+	prefix   string    // public part of the key
+	userId   int       // user owning the key
+}
+
+// Created returns the time of creation.
+func (k APIKey) Created() time.Time {
+	return k.created
+}
+
+// Expires returns the time the key expires. It is the zero time when the key
+// doesn't expire.
+func (k APIKey) Expires() time.Time {
+	return k.expires
+}
+
+// GroupIds returns the group id's the key is restricted to. When empty, the key
+// gives access to all groups of the user.
+func (k APIKey) GroupIds() []int {
+	return slices.Clone(k.groupIds)
+}
+
+// LastUsed returns the time of the last successful authentication with the
+// key. It is the zero time when the key hasn't been used.
+func (k APIKey) LastUsed() time.Time {
+	return k.lastUsed
+}
+
+// Name returns the name of the key.
+func (k APIKey) Name() string {
+	return k.name
+}
+
+// Prefix returns the public part of the key, which identifies it.
+func (k APIKey) Prefix() string {
+	return k.prefix
+}
+
+// UserId returns the user id of the user owning the key.
+func (k APIKey) UserId() int {
+	return k.userId
+}
+
+// String returns the API key line for a file. It holds the following fields
+// separated by semi colons: the prefix, the user id, the name, the hash of the
+// secret and the time of creation, followed by the optional fields for the
+// time of the last use, the expiry time and the group id's separated by
+// comma's.
+func (k APIKey) String() string {
+	return fmt.Sprintf("%s%s;%d;%s;%s;%s", apiKeyMark, k.prefix, k.userId, k.name,
+		k.hash, k.created.Format(time.RFC3339)) +
+		optionalFields(optionalTimeString(k.lastUsed), optionalTimeString(k.expires),
+			intsString(k.groupIds))
+}
+
+// APIKeys returns the API keys of the user with the provided user name or user
+// id, ordered by name.
+func (aU *AllUsers) APIKeys(uNameOrId interface{}) ([]APIKey, error) {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	u, found := selectUser(aU, uNameOrId)
+	if !found {
+		return nil, ErrNoSuchUser
+	}
+
+	keys := []APIKey{}
+	for _, k := range aU.apiKeys {
+		if k.userId == u.userId {
+			k.groupIds = slices.Clone(k.groupIds)
+			keys = append(keys, k)
+		}
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int {
+		return cmp.Compare(a.name, b.name)
+	})
+	return keys, nil
+}
+
+// AuthenticateAPIKey validates an API key created by CreateAPIKey() and
+// returns a copy of the user owning it. When the key is restricted to some
+// groups, the copy only holds those of the user's groups. Like Authenticate()
+// does, it returns an error with the message of ErrAuthenticationFailed only;
+// the reason can be found with errors.Is(): ErrInvalidAPIKey,
+// ErrAPIKeyExpired or, for users that are disabled, locked or expired,
+// ErrUserDeactivated, ErrAccountLocked or ErrAccountExpired. The time of the
+// last use of the key is updated, which will be reported by IsDirty().
+func (aU *AllUsers) AuthenticateAPIKey(key string) (*User, error) {
+	prefix, secret, _ := strings.Cut(strings.TrimSpace(key), ".")
+	h := []byte(secretHash(secret))
+
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	k, found := aU.apiKeys[prefix]
+	if !found {
+		return &User{}, &authError{ErrInvalidAPIKey}
+	}
+	if subtle.ConstantTimeCompare(h, []byte(k.hash)) != 1 {
+		return &User{}, &authError{ErrInvalidAPIKey}
+	}
+
+	now := time.Now()
+	if !k.expires.IsZero() && !now.Before(k.expires) {
+		return &User{}, &authError{ErrAPIKeyExpired}
+	}
+
+	u, found := aU.usersById[k.userId]
+	if !found {
+		return &User{}, &authError{ErrInvalidAPIKey}
+	}
+	// a password isn't needed, so users without one can use keys
+	if s := u.Status(); s != StatusActive && s != StatusPending {
+		return &User{}, &authError{u.statusError()}
+	}
+
+	k.lastUsed = now
+	aU.apiKeys[prefix] = k
+	aU.dirty = true
+
+	c := u.clone()
+	if len(k.groupIds) > 0 {
+		c.groupIds = slices.DeleteFunc(c.groupIds, func(id int) bool {
+			return !slices.Contains(k.groupIds, id)
+		})
+		c.memberOf = aU.effectiveGroups(c.groupIds)
+		c.scoped = true
+	}
+	return c, nil
+}
+
+// CreateAPIKey creates an API key named name for the user with the provided
+// user name or user id and returns it. The name must be unique for the user
+// and can't hold semi colons or line breaks. Only a hash of the secret part of
+// the key is stored, so the key can't be retrieved afterwards. The key expires
+// at expires, unless it's the zero time. When groupIds isn't empty, the key
+// only gives access to those groups, which must be groups of the user.
+func (aU *AllUsers) CreateAPIKey(uNameOrId interface{}, name string, expires time.Time, groupIds []int) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, ";\r\n") {
+		return "", fmt.Errorf("%w (API key name): %q", ErrInvalidField, name)
+	}
+
+	b := make([]byte, apiKeyPrefixLen+apiKeySecretLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	prefix := apiKeyPrefix + hex.EncodeToString(b[:apiKeyPrefixLen])
+	secret := base64.RawURLEncoding.EncodeToString(b[apiKeyPrefixLen:])
+
+	err := aU.update(uNameOrId, func(u *User) error {
+		ids := []int{}
+		for _, id := range groupIds {
+			if !u.IsInGroup(id) {
+				return fmt.Errorf("%w: user isn't in group %d", ErrInvalidGroupId, id)
+			}
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+		slices.Sort(ids)
+
+		if _, found := aU.apiKey(u.userId, name); found {
+			return fmt.Errorf("%w: %s", ErrAPIKeyExists, name)
+		}
+		if _, found := aU.apiKeys[prefix]; found {
+			return fmt.Errorf("%w: %s", ErrAPIKeyExists, prefix)
+		}
+
+		if aU.apiKeys == nil {
+			aU.apiKeys = make(map[string]APIKey)
+		}
+		aU.apiKeys[prefix] = APIKey{
+			created:  time.Now(),
+			expires:  expires,
+			groupIds: ids,
+			hash:     secretHash(secret),
+			name:     name,
+			prefix:   prefix,
+			userId:   u.userId,
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return prefix + "." + secret, nil
+}
+
+// RevokeAPIKey removes the API key named name of the user with the provided
+// user name or user id.
+func (aU *AllUsers) RevokeAPIKey(uNameOrId interface{}, name string) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		k, found := aU.apiKey(u.userId, strings.TrimSpace(name))
+		if !found {
+			return fmt.Errorf("%w: %s", ErrNoSuchAPIKey, name)
+		}
+		delete(aU.apiKeys, k.prefix)
+		return nil
+	})
+}
+
+// apiKey returns the API key named name of the user with user id id.
+func (aU *AllUsers) apiKey(id int, name string) (APIKey, bool) {
+	for _, k := range aU.apiKeys {
+		if k.userId == id && k.name == name {
+			return k, true
+		}
+	}
+	return APIKey{}, false
+}
+
+// apiKeyStrings returns the API key lines, ordered by user id and name.
+func (aU *AllUsers) apiKeyStrings() []string {
+	keys := make([]APIKey, 0, len(aU.apiKeys))
+	for _, k := range aU.apiKeys {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int {
+		if c := cmp.Compare(a.userId, b.userId); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.name, b.name)
+	})
+
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = k.String()
+	}
+	return lines
+}
+
+// dropAPIKeys removes the API keys of the user with user id id.
+func (aU *AllUsers) dropAPIKeys(id int) {
+	for prefix, k := range aU.apiKeys {
+		if k.userId == id {
+			delete(aU.apiKeys, prefix)
+		}
+	}
+}
+
+// parseAPIKey parses an API key line as returned by APIKey.String() and
+// stores it in aU.
+func (aU *AllUsers) parseAPIKey(s string) error {
+	fields := strings.Split(strings.TrimPrefix(s, apiKeyMark), ";")
+	if l := len(fields); l < 5 {
+		return fmt.Errorf("%w, less than 6 fields found for API key: %d",
+			ErrMissingData, l+1)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	k := APIKey{prefix: fields[0], name: fields[2], hash: fields[3]}
+	if !strings.HasPrefix(k.prefix, apiKeyPrefix) {
+		return fmt.Errorf("%w (API key prefix): %q", ErrInvalidField, k.prefix)
+	}
+
+	var err error
+	k.userId, err = strconv.Atoi(fields[1])
+	if err != nil || k.userId <= 0 {
+		return fmt.Errorf("%w for API key %s: %s", ErrInvalidUserId, k.prefix, fields[1])
+	}
+
+	if _, err = hex.DecodeString(k.hash); err != nil || len(k.hash) != 2*sha256.Size {
+		return fmt.Errorf("%w (API key hash) for API key %s: %q", ErrInvalidField, k.prefix, k.hash)
+	}
+
+	if k.created, err = time.Parse(time.RFC3339, fields[4]); err != nil {
+		return fmt.Errorf("%w (creation) for API key %s: %w", ErrInvalidTime, k.prefix, err)
+	}
+
+	for i, fld := range fields[5:min(len(fields), 8)] {
+		switch i + 5 {
+		case 5: // time of the last use
+			if k.lastUsed, err = parseOptionalTime(fld); err != nil {
+				return fmt.Errorf("%w (last use) for API key %s: %w", ErrInvalidTime, k.prefix, err)
+			}
+
+		case 6: // expiry time
+			if k.expires, err = parseOptionalTime(fld); err != nil {
+				return fmt.Errorf("%w (expiry) for API key %s: %w", ErrInvalidTime, k.prefix, err)
+			}
+
+		case 7: // group id's
+			for _, sId := range strings.Split(fld, ",") {
+				if sId == "" {
+					continue
+				}
+				id, err := strconv.Atoi(strings.TrimSpace(sId))
+				if err != nil || id < 0 {
+					return fmt.Errorf("%w for API key %s: %q", ErrInvalidGroupId, k.prefix, sId)
+				}
+				k.groupIds = append(k.groupIds, id)
+			}
+		}
+	}
+
+	if aU.apiKeys == nil {
+		aU.apiKeys = make(map[string]APIKey)
+	}
+	aU.apiKeys[k.prefix] = k
+	return nil
+}
@@ -0,0 +1,154 @@
+package users
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	aU, err := ParseAll("a@b.c;*;1;1,2,3;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"d@e.f;*;2;1;D;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	ci, err := aU.CreateAPIKey(1, "ci", time.Time{}, []int{2})
+	if err != nil {
+		t.Fatalf("CreateAPIKey() returns an error: %s", err.Error())
+	}
+	script, err := aU.CreateAPIKey("a@b.c", "script", time.Now().Add(time.Hour), nil)
+	if err != nil {
+		t.Fatalf("CreateAPIKey() returns an error: %s", err.Error())
+	}
+	old, err := aU.CreateAPIKey(2, "old", time.Now().Add(-time.Hour), nil)
+	if err != nil {
+		t.Fatalf("CreateAPIKey() returns an error: %s", err.Error())
+	}
+
+	createTests := []struct {
+		uNameOrId interface{}
+		name      string
+		groupIds  []int
+		err       error
+	}{
+		{1, "ci", nil, ErrAPIKeyExists},
+		{2, "ci", nil, nil},
+		{1, "", nil, ErrInvalidField},
+		{1, "a;b", nil, ErrInvalidField},
+		{1, "other", []int{4}, ErrInvalidGroupId},
+		{3, "other", nil, ErrNoSuchUser},
+	}
+	for _, tst := range createTests {
+		_, err := aU.CreateAPIKey(tst.uNameOrId, tst.name, time.Time{}, tst.groupIds)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("CreateAPIKey(%v, %q) returns error %q, should be %q", tst.uNameOrId, tst.name, sE1, sE2)
+		}
+	}
+
+	// only the hashes of the secrets are stored
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	_, secret, _ := strings.Cut(ci, ".")
+	if strings.Contains(s, secret) {
+		t.Errorf("String() holds the secret of an API key")
+	}
+	if aU, err = ParseAll(s); err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	keys, err := aU.APIKeys(1)
+	if err != nil {
+		t.Fatalf("APIKeys() returns an error: %s", err.Error())
+	}
+	if len(keys) != 2 || keys[0].Name() != "ci" || keys[1].Name() != "script" {
+		t.Fatalf("APIKeys() returns %d keys", len(keys))
+	}
+	if !strings.HasPrefix(ci, keys[0].Prefix()+".") || !slices.Equal(keys[0].GroupIds(), []int{2}) ||
+		!keys[0].LastUsed().IsZero() || keys[0].UserId() != 1 {
+		t.Errorf("APIKeys() returns key %s", keys[0].String())
+	}
+
+	tests := []struct {
+		key      string
+		groupIds []int
+		reason   error
+	}{
+		{ci, []int{2}, nil},
+		{script, []int{1, 2, 3}, nil},
+		{ci + "x", nil, ErrInvalidAPIKey},
+		{"usk_000000000000." + secret, nil, ErrInvalidAPIKey},
+		{"", nil, ErrInvalidAPIKey},
+		{old, nil, ErrAPIKeyExpired},
+	}
+	for _, tst := range tests {
+		u, err := aU.AuthenticateAPIKey(tst.key)
+		if tst.reason == nil {
+			if err != nil {
+				t.Errorf("AuthenticateAPIKey(%q) returns an error: %s", tst.key, err.Error())
+			} else if u.UserId() != 1 || !slices.Equal(u.GroupIds(), tst.groupIds) {
+				t.Errorf("AuthenticateAPIKey(%q) returns user %d with groups %v", tst.key, u.UserId(), u.GroupIds())
+			}
+			continue
+		}
+
+		if !errors.Is(err, ErrAuthenticationFailed) || !errors.Is(err, tst.reason) {
+			t.Errorf("AuthenticateAPIKey(%q) returns error %v, should be %s and %s",
+				tst.key, err, ErrAuthenticationFailed, tst.reason)
+		}
+	}
+
+	if keys, _ = aU.APIKeys(1); keys[0].LastUsed().IsZero() {
+		t.Errorf("AuthenticateAPIKey() doesn't update the time of the last use")
+	}
+
+	aU.Deactivate(1)
+	if _, err = aU.AuthenticateAPIKey(ci); !errors.Is(err, ErrUserDeactivated) {
+		t.Errorf("AuthenticateAPIKey() for a deactivated user returns error %v, should be %s", err, ErrUserDeactivated)
+	}
+	aU.Reactivate(1)
+
+	if err = aU.RevokeAPIKey(1, "ci"); err != nil {
+		t.Fatalf("RevokeAPIKey() returns an error: %s", err.Error())
+	}
+	if _, err = aU.AuthenticateAPIKey(ci); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("AuthenticateAPIKey() for a revoked key returns error %v, should be %s", err, ErrInvalidAPIKey)
+	}
+	if err = aU.RevokeAPIKey(1, "ci"); !errors.Is(err, ErrNoSuchAPIKey) {
+		t.Errorf("RevokeAPIKey() returns error %v, should be %s", err, ErrNoSuchAPIKey)
+	}
+
+	aU.Remove(1)
+	if _, err = aU.AuthenticateAPIKey(script); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("AuthenticateAPIKey() for a removed user returns error %v, should be %s", err, ErrInvalidAPIKey)
+	}
+}
+
+func TestParseAPIKey(t *testing.T) {
+	h := secretHash("secret")
+	tests := []struct {
+		s   string
+		err error
+	}{
+		{"k;usk_0123;1;ci;" + h + ";2023-11-24T15:38:00Z", nil},
+		{"k;usk_0123;1;ci;" + h + ";2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;;1,2", nil},
+		{"k;usk_0123;1;ci;" + h, ErrMissingData},
+		{"k;0123;1;ci;" + h + ";2023-11-24T15:38:00Z", ErrInvalidField},
+		{"k;usk_0123;0;ci;" + h + ";2023-11-24T15:38:00Z", ErrInvalidUserId},
+		{"k;usk_0123;1;ci;abc;2023-11-24T15:38:00Z", ErrInvalidField},
+		{"k;usk_0123;1;ci;" + h + ";today", ErrInvalidTime},
+		{"k;usk_0123;1;ci;" + h + ";2023-11-24T15:38:00Z;;later", ErrInvalidTime},
+		{"k;usk_0123;1;ci;" + h + ";2023-11-24T15:38:00Z;;;x", ErrInvalidGroupId},
+	}
+
+	for _, tst := range tests {
+		_, err := ParseAll(tst.s + "\n")
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("ParseAll(%q) returns error %q, should be %q", tst.s, sE1, sE2)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package users
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type tags of attribute values as stored in a file.
+const (
+	attrBool   = "b"
+	attrFloat  = "f"
+	attrInt    = "i"
+	attrString = "s"
+	attrTime   = "t"
+)
+
+// attrMap holds the custom attributes of a user, the key is the name of an
+// attribute.
+type attrMap map[string]any
+
+// validatorMap holds validators of attributes, the key is the name of an
+// attribute.
+type validatorMap map[string]func(value any) error
+
+// AttributeEquals returns a filter for GetFunc() selecting the users having
+// attribute key with value.
+func AttributeEquals(key string, value any) func(u User) bool {
+	return func(u User) bool {
+		v, found := u.attributes[key]
+		if !found {
+			return false
+		}
+		if t, ok := value.(time.Time); ok {
+			vt, ok := v.(time.Time)
+			return ok && vt.Equal(t)
+		}
+		return v == value
+	}
+}
+
+// HasAttribute returns a filter for GetFunc() selecting the users having
+// attribute key.
+func HasAttribute(key string) func(u User) bool {
+	return func(u User) bool {
+		_, found := u.attributes[key]
+		return found
+	}
+}
+
+// Attribute returns the value of attribute key and whether the user has it.
+// The value is a string, an int, a float64, a bool or a time.Time.
+func (u User) Attribute(key string) (any, bool) {
+	v, found := u.attributes[key]
+	return v, found
+}
+
+// AttributeKeys returns the keys of the attributes of the user in alphabetical
+// order.
+func (u User) AttributeKeys() []string {
+	keys := make([]string, 0, len(u.attributes))
+	for key := range u.attributes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// DeleteAttribute removes attribute key.
+func (u *User) DeleteAttribute(key string) {
+	if _, found := u.attributes[key]; !found {
+		return
+	}
+
+	delete(u.attributes, key)
+	u.modified = time.Now()
+}
+
+// SetAttribute sets attribute key to value, which must be a string, an int, a
+// float64, a bool or a time.Time. A key can't be empty or hold white space,
+// semi colons, colons or comma's. Otherwise ErrInvalidAttribute is returned.
+func (u *User) SetAttribute(key string, value any) error {
+	value, err := validateAttribute(key, value)
+	if err != nil {
+		return err
+	}
+
+	if u.attributes == nil {
+		u.attributes = make(attrMap)
+	}
+	u.attributes[key] = value
+	u.modified = time.Now()
+	return nil
+}
+
+// DeleteAttribute removes attribute key of the user with the provided user
+// name or user id.
+func (aU *AllUsers) DeleteAttribute(uNameOrId interface{}, key string) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		u.DeleteAttribute(key)
+		return nil
+	})
+}
+
+// SetAttribute sets attribute key of the user with the provided user name or
+// user id to value. See User.SetAttribute(). When a validator has been set for
+// the key by SetAttributeValidator(), the value must pass it.
+func (aU *AllUsers) SetAttribute(uNameOrId interface{}, key string, value any) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		if validate := aU.validators[key]; validate != nil {
+			if err := validate(value); err != nil {
+				return fmt.Errorf("%w %s: %w", ErrInvalidAttribute, key, err)
+			}
+		}
+		return u.SetAttribute(key, value)
+	})
+}
+
+// SetAttributeValidator sets a function validating the values of attribute
+// key, which is called by SetAttribute(). A nil function removes it. As the
+// function is called while holding the lock of aU, it can't call methods of
+// aU.
+func (aU *AllUsers) SetAttributeValidator(key string, validate func(value any) error) {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	if validate == nil {
+		delete(aU.validators, key)
+		return
+	}
+	if aU.validators == nil {
+		aU.validators = make(validatorMap)
+	}
+	aU.validators[key] = validate
+}
+
+// attributesString returns the attributes field of u: "key=value" pairs
+// separated by "&", ordered by key. A value is preceded by a tag for its type
+// and a colon. Keys and values are escaped like in a URL query, so they can't
+// hold semi colons or other characters with a meaning in a file.
+func (u User) attributesString() string {
+	pairs := []string{}
+	for _, key := range u.AttributeKeys() {
+		var tag, s string
+		switch v := u.attributes[key].(type) {
+		case bool:
+			tag, s = attrBool, strconv.FormatBool(v)
+		case float64:
+			tag, s = attrFloat, strconv.FormatFloat(v, 'g', -1, 64)
+		case int:
+			tag, s = attrInt, strconv.Itoa(v)
+		case string:
+			tag, s = attrString, v
+		case time.Time:
+			tag, s = attrTime, v.Format(time.RFC3339Nano)
+		}
+		pairs = append(pairs, url.QueryEscape(key)+"="+tag+":"+url.QueryEscape(s))
+	}
+	return strings.Join(pairs, "&")
+}
+
+// parseAttributes parses an attributes field as returned by
+// attributesString() and sets the attributes of u.
+func (u *User) parseAttributes(s string) error {
+	if s == "" {
+		return nil
+	}
+
+	u.attributes = make(attrMap)
+	for _, pair := range strings.Split(s, "&") {
+		eKey, tagged, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("%w: %q", ErrInvalidAttribute, pair)
+		}
+		key, err := url.QueryUnescape(eKey)
+		if err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidAttribute, eKey)
+		}
+
+		tag, eValue, _ := strings.Cut(tagged, ":")
+		sValue, err := url.QueryUnescape(eValue)
+		if err != nil {
+			return fmt.Errorf("%w %s: %q", ErrInvalidAttribute, key, eValue)
+		}
+
+		var value any
+		switch tag {
+		case attrBool:
+			value, err = strconv.ParseBool(sValue)
+		case attrFloat:
+			value, err = strconv.ParseFloat(sValue, 64)
+		case attrInt:
+			value, err = strconv.Atoi(sValue)
+		case attrString:
+			value = sValue
+		case attrTime:
+			value, err = time.Parse(time.RFC3339Nano, sValue)
+		default:
+			err = fmt.Errorf("unknown type %q", tag)
+		}
+		if err != nil {
+			return fmt.Errorf("%w %s: %w", ErrInvalidAttribute, key, err)
+		}
+
+		if value, err = validateAttribute(key, value); err != nil {
+			return err
+		}
+		u.attributes[key] = value
+	}
+	return nil
+}
+
+// validateAttribute returns ErrInvalidAttribute if key or value can't be used
+// for an attribute. Otherwise it returns value as it is stored.
+func validateAttribute(key string, value any) (any, error) {
+	if err := validateName(key, ErrInvalidAttribute); err != nil {
+		return nil, err
+	}
+
+	switch v := value.(type) {
+	case string, int, bool:
+	case float64:
+		if math.IsNaN(v) {
+			return nil, fmt.Errorf("%w %s: NaN", ErrInvalidAttribute, key)
+		}
+	case time.Time:
+		value = v.Round(0) // drop the monotonic clock reading
+	default:
+		return nil, fmt.Errorf("%w %s: unsupported type %T", ErrInvalidAttribute, key, value)
+	}
+	return value, nil
+}
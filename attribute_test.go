@@ -0,0 +1,137 @@
+package users
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttributes(t *testing.T) {
+	aU, err := ParseAll("a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"d@e.f;*;2;1;D;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	aU.SetAttributeValidator("locale", func(value any) error {
+		if s, ok := value.(string); !ok || len(s) != 5 {
+			return errors.New("not a locale")
+		}
+		return nil
+	})
+
+	hired := time.Date(2020, 3, 1, 9, 30, 0, 123, time.UTC)
+	tests := []struct {
+		uNameOrId interface{}
+		key       string
+		value     any
+		err       error
+	}{
+		{1, "department", "Sales; EMEA & more=100%\nsecond line", nil},
+		{1, "phone", "+31 6 12345678", nil},
+		{1, "locale", "nl_NL", nil},
+		{1, "hr-id", 4711, nil},
+		{1, "fte", 0.8, nil},
+		{1, "remote", true, nil},
+		{1, "hired", hired, nil},
+		{2, "department", "Support", nil},
+		{2, "locale", "nl", ErrInvalidAttribute},
+		{2, "hr id", 4712, ErrInvalidAttribute},
+		{2, "hr-id", int64(4712), ErrInvalidAttribute},
+		{3, "hr-id", 4712, ErrNoSuchUser},
+	}
+	for _, tst := range tests {
+		err := aU.SetAttribute(tst.uNameOrId, tst.key, tst.value)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("SetAttribute(%v, %q) returns error %q, should be %q", tst.uNameOrId, tst.key, sE1, sE2)
+		}
+	}
+
+	// the attributes survive writing and parsing
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	if lines := strings.Split(s, "\n"); len(lines) != 3 || strings.Count(lines[0], ";") != 17 {
+		t.Fatalf("String() doesn't escape attributes: %q", s)
+	}
+	if aU, err = ParseAll(s); err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	u, _ := aU.Get(1)
+	if got, want := u.AttributeKeys(), []string{"department", "fte", "hired", "hr-id", "locale", "phone", "remote"}; !slices.Equal(got, want) {
+		t.Errorf("AttributeKeys() returns %v, should be %v", got, want)
+	}
+	for _, tst := range tests[:7] {
+		v, found := u.Attribute(tst.key)
+		if tm, ok := v.(time.Time); ok && tm.Equal(hired) {
+			continue
+		}
+		if !found || v != tst.value {
+			t.Errorf("Attribute(%q) returns %v (%T), should be %v (%T)", tst.key, v, v, tst.value, tst.value)
+		}
+	}
+
+	filters := []struct {
+		f       func(u User) bool
+		userIds []int
+	}{
+		{HasAttribute("department"), []int{1, 2}},
+		{HasAttribute("phone"), []int{1}},
+		{AttributeEquals("department", "Support"), []int{2}},
+		{AttributeEquals("hr-id", 4711), []int{1}},
+		{AttributeEquals("hr-id", "4711"), []int{}},
+		{AttributeEquals("hired", hired.In(time.FixedZone("CET", 3600))), []int{1}},
+	}
+	for i, tst := range filters {
+		ids := []int{}
+		for _, u := range aU.GetFunc(tst.f) {
+			ids = append(ids, u.UserId())
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, tst.userIds) {
+			t.Errorf("%d: GetFunc() returns users %v, should be %v", i, ids, tst.userIds)
+		}
+	}
+
+	if err = aU.DeleteAttribute(1, "phone"); err != nil {
+		t.Errorf("DeleteAttribute() returns an error: %s", err.Error())
+	}
+	if u, _ = aU.Get(1); HasAttribute("phone")(*u) {
+		t.Errorf("DeleteAttribute() doesn't delete the attribute")
+	}
+
+	// a copy doesn't share its attributes
+	u.SetAttribute("department", "Other")
+	if u2, _ := aU.Get(1); AttributeEquals("department", "Other")(*u2) {
+		t.Errorf("SetAttribute() on a copy changes the user in AllUsers")
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	prefix := "a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;;;;;;;;;;;"
+	tests := []struct {
+		s   string
+		err error
+	}{
+		{"a=s:x&b=i:1&c=b:true&d=f:1.5&e=t:2023-11-24T15%3A38%3A00Z", nil},
+		{"a", ErrInvalidAttribute},
+		{"a=x:1", ErrInvalidAttribute},
+		{"a=i:x", ErrInvalidAttribute},
+		{"a=s:%zz", ErrInvalidAttribute},
+		{"a+b=s:x", ErrInvalidAttribute},
+	}
+
+	for _, tst := range tests {
+		u, err := Parse(prefix + tst.s)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("Parse(%q) returns error %q, should be %q", tst.s, sE1, sE2)
+		}
+		if err == nil && u.String() != prefix+tst.s {
+			t.Errorf("Parse(%q) writes %q", tst.s, u.String())
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package users
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDummyHash returns the dummy hash for the default Hasher, see
+// newDummyHash(). It's generated once, by ParseAll(), so it doesn't slow down
+// the first login of an unknown user.
+var defaultDummyHash = sync.OnceValue(func() string {
+	return newDummyHash(defaultHasher)
+})
+
+// LockoutPolicy defines when an account gets locked after consecutive failed
+// login attempts. Successful authentication resets the number of failed
+// attempts.
+type LockoutPolicy struct {
+	// Backoff doubles the time an account stays locked for every failed
+	// attempt beyond MaxFailures.
+	Backoff bool
+
+	// Duration is the time an account stays locked after the last failed
+	// attempt. A zero value keeps it locked until Unlock() is called.
+	Duration time.Duration
+
+	// MaxFailures is the number of failed attempts that locks an account.
+	// A zero value disables locking.
+	MaxFailures int
+}
+
+// isLocked returns true if, at time now, an account is locked after failures
+// consecutive failed login attempts, the last one at time last.
+func (p LockoutPolicy) isLocked(failures int, last, now time.Time) bool {
+	if p.MaxFailures <= 0 || failures < p.MaxFailures {
+		return false
+	}
+	if p.Duration <= 0 {
+		return true
+	}
+
+	d := p.Duration
+	if p.Backoff {
+		for i := p.MaxFailures; i < failures && d < math.MaxInt64/2; i++ {
+			d *= 2
+		}
+	}
+	return now.Before(last.Add(d))
+}
+
+// authError is returned by Authenticate. Its message doesn't reveal why
+// authentication failed, but the reason can be found with errors.Is().
+type authError struct {
+	reason error // the real reason of the failure
+}
+
+// Error returns the message of ErrAuthenticationFailed.
+func (e *authError) Error() string {
+	return ErrAuthenticationFailed.Error()
+}
+
+// Unwrap returns ErrAuthenticationFailed and the real reason of the failure.
+func (e *authError) Unwrap() []error {
+	return []error{ErrAuthenticationFailed, e.reason}
+}
+
+// Authenticate validates the password of the user with user name userName. On
+// success it returns a copy of the user.
+//
+// On failure an error is returned with the message of ErrAuthenticationFailed
+// only, so it can be passed on to clients. The real reason can be found with
+// errors.Is(): ErrNoSuchUser, ErrNoPassword, ErrUserDeactivated,
+// ErrAccountLocked, ErrAccountExpired or ErrInvalidPassword. For unknown users
+// and users that aren't active, a password is compared with a dummy hash, so
+// it takes as long as for other users and the time taken doesn't reveal which
+// users exist.
+//
+// Consecutive failed attempts are counted. An account gets locked either by
+// the policy set by SetLockoutPolicy() or by Lock().
+//
+// When the password is valid, but it must be changed or it's older than the
+// maximum age set by SetMaxPasswordAge(), a copy of the user is returned
+// together with ErrPasswordChangeRequired or ErrPasswordExpired respectively.
+// The user is authenticated then, but shouldn't get access before the password
+// has been changed.
+//
+// When the user has enabled TOTP, a copy of the user is returned together with
+// ErrSecondFactorRequired. The user shouldn't get access before a code has
+// been accepted by VerifyTOTP(). If the password must be changed as well,
+// errors.Is() reports that too.
+//
+// When the stored hash hasn't been generated by the Hasher set by SetHasher()
+// or with other parameters, the password will be re-hashed with that Hasher.
+// Like any other modification this will be reported by IsDirty(), so the next
+// Write() persists it.
+func (aU *AllUsers) Authenticate(userName, plainPassword string) (*User, error) {
+	aU.mu.RLock()
+	u, found := selectUser(aU, strings.TrimSpace(userName))
+	hash := u.hashedPassword
+	statusErr := u.statusError()
+	failures, lastFailure := u.failures, u.lastFailure
+	hasher := aU.hasherOrDefault()
+	dummyHash := aU.dummyHash
+	lockout := aU.lockout
+	maxPwAge := aU.maxPwAge
+	aU.mu.RUnlock()
+
+	now := time.Now()
+
+	var reason error
+	switch {
+	case !found:
+		reason = ErrNoSuchUser
+	case statusErr != nil:
+		reason = statusErr
+	case lockout.isLocked(failures, lastFailure, now):
+		reason = ErrAccountLocked
+	}
+
+	if reason != nil {
+		if dummyHash == "" {
+			dummyHash = defaultDummyHash()
+		}
+		compareHash(dummyHash, plainPassword)
+		return &User{}, &authError{reason}
+	}
+
+	err := compareHash(hash, plainPassword)
+
+	var newHash string
+	if err == nil && hasher.NeedsRehash(hash) {
+		// a failure only means the old hash is kept
+		newHash, _ = hasher.Hash(plainPassword)
+	}
+
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	// u might have been removed in the meantime
+	inAU := u.allUsers == aU
+
+	if err != nil {
+		if inAU {
+			u.failures++
+			u.lastFailure = now
+			aU.dirty = true
+		}
+		return &User{}, &authError{fmt.Errorf("%w: %w", ErrInvalidPassword, err)}
+	}
+
+	if inAU && u.failures > 0 {
+		u.failures = 0
+		u.lastFailure = time.Time{}
+		aU.dirty = true
+	}
+
+	// check before a new hash changes the time of the last password change
+	err = passwordError(*u, maxPwAge, now)
+	if u.TOTPEnabled() {
+		if err != nil {
+			err = fmt.Errorf("%w, %w", ErrSecondFactorRequired, err)
+		} else {
+			err = ErrSecondFactorRequired
+		}
+	}
+
+	// don't replace a hash that has been changed in the meantime
+	if newHash != "" && inAU && u.hashedPassword == hash {
+		pwChanged, mustChange := u.pwChanged, u.mustChange
+		u.setHashedPassword(newHash)
+		u.pwChanged, u.mustChange = pwChanged, mustChange
+		aU.dirty = true
+	}
+	return u.clone(), err
+}
+
+// IsLocked returns true if the account of the user with the provided user
+// name or user id is locked by Lock() or by the policy set by
+// SetLockoutPolicy().
+func (aU *AllUsers) IsLocked(uNameOrId interface{}) (bool, error) {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	u, found := selectUser(aU, uNameOrId)
+	if !found {
+		return false, ErrNoSuchUser
+	}
+	return u.status == StatusLocked ||
+		aU.lockout.isLocked(u.failures, u.lastFailure, time.Now()), nil
+}
+
+// Lock locks the account of the user with the provided user name or user id
+// until Unlock() is called. Its status becomes StatusLocked.
+func (aU *AllUsers) Lock(uNameOrId interface{}) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		u.SetStatus(StatusLocked)
+		return nil
+	})
+}
+
+// SetLockoutPolicy sets the policy for locking accounts after consecutive
+// failed login attempts. By default accounts are never locked.
+func (aU *AllUsers) SetLockoutPolicy(p LockoutPolicy) {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	aU.lockout = p
+}
+
+// SetMaxPasswordAge sets the maximum age of passwords. Authenticate() reports
+// older ones with ErrPasswordExpired. For passwords of which the time of the
+// last change isn't known, the last modification time of the user is used.
+// A zero value, the default, means passwords don't expire.
+func (aU *AllUsers) SetMaxPasswordAge(d time.Duration) {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	aU.maxPwAge = d
+}
+
+// Unlock clears the failed login attempts of the user with the provided user
+// name or user id and reactivates it when it has been locked by Lock(), so
+// its account isn't locked anymore.
+func (aU *AllUsers) Unlock(uNameOrId interface{}) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		u.failures = 0
+		u.lastFailure = time.Time{}
+		u.modified = time.Now()
+		if u.status == StatusLocked {
+			u.Reactivate()
+		}
+		return nil
+	})
+}
+
+// passwordError returns ErrPasswordChangeRequired if the password of u must
+// be changed, or ErrPasswordExpired if, at time now, it's older than maxAge.
+func passwordError(u User, maxAge time.Duration, now time.Time) error {
+	if u.mustChange {
+		return ErrPasswordChangeRequired
+	}
+
+	changed := u.pwChanged
+	if changed.IsZero() {
+		changed = u.modified
+	}
+	if maxAge > 0 && now.After(changed.Add(maxAge)) {
+		return ErrPasswordExpired
+	}
+	return nil
+}
+
+// newDummyHash generates a hash with hasher to compare passwords of unknown
+// and deactivated users with.
+func newDummyHash(hasher Hasher) string {
+	h, err := hasher.Hash("not a password of any user")
+	if err != nil {
+		return ""
+	}
+	return h
+}
@@ -0,0 +1,297 @@
+package users
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticate(t *testing.T) {
+	pwd := "a@pNn00tm13s"
+	hash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash(pwd)
+	if err != nil {
+		t.Fatalf("Hash() returns an error: %s", err.Error())
+	}
+
+	aU, err := ParseAll("a@b.c;" + hash + ";1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"d@e.f;*" + hash + ";2;1;D;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"g@h.i;*;3;1;G;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+	if aU.dummyHash == "" || aU.hasher.NeedsRehash(aU.dummyHash) {
+		t.Errorf("SetHasher() doesn't generate a dummy hash for the hasher: %q", aU.dummyHash)
+	}
+
+	tests := []struct {
+		userName string
+		password string
+		reason   error
+	}{
+		{"a@b.c", pwd, nil},
+		{" a@b.c ", pwd, nil},
+		{"a@b.c", pwd + "_", ErrInvalidPassword},
+		{"x@b.c", pwd, ErrNoSuchUser},
+		{"d@e.f", pwd, ErrUserDeactivated},
+		{"g@h.i", pwd, ErrNoPassword},
+	}
+
+	for _, tst := range tests {
+		u, err := aU.Authenticate(tst.userName, tst.password)
+		if tst.reason == nil {
+			if err != nil {
+				t.Errorf("Authenticate(%q) returns an error: %s", tst.userName, err.Error())
+			} else if u.UserName() != "a@b.c" {
+				t.Errorf("Authenticate(%q) returns user %q", tst.userName, u.UserName())
+			}
+			continue
+		}
+
+		if !errors.Is(err, ErrAuthenticationFailed) || !errors.Is(err, tst.reason) {
+			t.Errorf("Authenticate(%q) returns error %v, should be %s and %s",
+				tst.userName, err, ErrAuthenticationFailed, tst.reason)
+		} else if got, want := err.Error(), ErrAuthenticationFailed.Error(); got != want {
+			t.Errorf("Authenticate(%q) returns error message %q, should be %q",
+				tst.userName, got, want)
+		}
+	}
+
+	if err = aU.Lock(1); err != nil {
+		t.Fatalf("Lock() returns an error: %s", err.Error())
+	}
+	if _, err = aU.Authenticate("a@b.c", pwd); !errors.Is(err, ErrAccountLocked) {
+		t.Errorf("Authenticate() returns error %v, should be %s", err, ErrAccountLocked)
+	}
+	if err = aU.Unlock(1); err != nil {
+		t.Fatalf("Unlock() returns an error: %s", err.Error())
+	}
+	if _, err = aU.Authenticate("a@b.c", pwd); err != nil {
+		t.Errorf("Authenticate() after Unlock() returns an error: %s", err.Error())
+	}
+}
+
+func TestLockout(t *testing.T) {
+	pwd := "a@pNn00tm13s"
+	hash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash(pwd)
+	if err != nil {
+		t.Fatalf("Hash() returns an error: %s", err.Error())
+	}
+
+	aU, err := ParseAll("a@b.c;" + hash + ";1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+	aU.SetLockoutPolicy(LockoutPolicy{MaxFailures: 3})
+
+	for i := 1; i <= 3; i++ {
+		if _, err = aU.Authenticate("a@b.c", "wrong"); !errors.Is(err, ErrInvalidPassword) {
+			t.Errorf("Authenticate() returns error %v, should be %s", err, ErrInvalidPassword)
+		}
+		if u, _ := aU.Get(1); u.FailedLogins() != i || u.LastFailedLogin().IsZero() {
+			t.Errorf("FailedLogins() returns %d, should be %d", u.FailedLogins(), i)
+		}
+	}
+
+	_, err = aU.Authenticate("a@b.c", pwd)
+	if !errors.Is(err, ErrAccountLocked) || !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Authenticate() returns error %v, should be %s", err, ErrAccountLocked)
+	}
+	if got, want := err.Error(), ErrAuthenticationFailed.Error(); got != want {
+		t.Errorf("Authenticate() returns message %q, should be %q", got, want)
+	}
+	if locked, _ := aU.IsLocked(1); !locked {
+		t.Errorf("IsLocked() returns false, should be true")
+	}
+
+	// the failures should survive writing and reading
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	aU2, err := ParseAll(s)
+	if err != nil {
+		t.Fatalf("ParseAll(%q) returns an error: %s", s, err.Error())
+	}
+	if u, _ := aU2.Get(1); u.FailedLogins() != 3 {
+		t.Errorf("FailedLogins() after ParseAll() returns %d, should be 3", u.FailedLogins())
+	}
+
+	if err = aU.Unlock(1); err != nil {
+		t.Fatalf("Unlock() returns an error: %s", err.Error())
+	}
+	if _, err = aU.Authenticate("a@b.c", pwd); err != nil {
+		t.Errorf("Authenticate() after Unlock() returns an error: %s", err.Error())
+	}
+}
+
+func TestLockoutPolicy(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		policy   LockoutPolicy
+		failures int
+		last     time.Time
+		want     bool
+	}{
+		{LockoutPolicy{}, 100, now, false},
+		{LockoutPolicy{MaxFailures: 3}, 2, now, false},
+		{LockoutPolicy{MaxFailures: 3}, 3, now.Add(-24 * time.Hour), true},
+		{LockoutPolicy{MaxFailures: 3, Duration: time.Minute}, 3, now.Add(-30 * time.Second), true},
+		{LockoutPolicy{MaxFailures: 3, Duration: time.Minute}, 3, now.Add(-90 * time.Second), false},
+		{LockoutPolicy{MaxFailures: 3, Duration: time.Minute}, 5, now.Add(-90 * time.Second), false},
+		{LockoutPolicy{MaxFailures: 3, Duration: time.Minute, Backoff: true}, 4, now.Add(-90 * time.Second), true},
+		{LockoutPolicy{MaxFailures: 3, Duration: time.Minute, Backoff: true}, 4, now.Add(-150 * time.Second), false},
+		{LockoutPolicy{MaxFailures: 3, Duration: time.Minute, Backoff: true}, 5, now.Add(-150 * time.Second), true},
+		{LockoutPolicy{MaxFailures: 1, Duration: time.Hour, Backoff: true}, 1000, now.Add(-24 * time.Hour), true},
+	}
+
+	for _, tst := range tests {
+		if got := tst.policy.isLocked(tst.failures, tst.last, now); got != tst.want {
+			t.Errorf("%+v.isLocked(%d, %s) returns %t, should be %t", tst.policy,
+				tst.failures, now.Sub(tst.last), got, tst.want)
+		}
+	}
+}
+
+func TestPasswordExpiry(t *testing.T) {
+	pwd := "a@pNn00tm13s"
+	hash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash(pwd)
+	if err != nil {
+		t.Fatalf("Hash() returns an error: %s", err.Error())
+	}
+
+	aU, err := ParseAll("a@b.c;" + hash + ";1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"d@e.f;" + hash + ";2;1;D;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;;;;" +
+		time.Now().Add(-time.Hour).Format(time.RFC3339) + "\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+	aU.SetMaxPasswordAge(24 * time.Hour)
+
+	if _, err = aU.Authenticate("d@e.f", pwd); err != nil {
+		t.Errorf("Authenticate() returns an error: %s", err.Error())
+	}
+
+	u, err := aU.Authenticate("a@b.c", pwd)
+	if !errors.Is(err, ErrPasswordExpired) {
+		t.Errorf("Authenticate() returns error %v, should be %s", err, ErrPasswordExpired)
+	} else if u.UserName() != "a@b.c" {
+		t.Errorf("Authenticate() returns user %q, should be %q", u.UserName(), "a@b.c")
+	}
+
+	if err = aU.SetPassword("a@b.c", pwd+"!"); err != nil {
+		t.Fatalf("SetPassword() returns an error: %s", err.Error())
+	}
+	if _, err = aU.Authenticate("a@b.c", pwd+"!"); err != nil {
+		t.Errorf("Authenticate() after SetPassword() returns an error: %s", err.Error())
+	}
+
+	if err = aU.SetMustChangePassword("a@b.c", true); err != nil {
+		t.Fatalf("SetMustChangePassword() returns an error: %s", err.Error())
+	}
+
+	// the flag should survive writing and reading
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	if aU, err = ParseAll(s); err != nil {
+		t.Fatalf("ParseAll(%q) returns an error: %s", s, err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+
+	if _, err = aU.Authenticate("a@b.c", pwd+"!"); !errors.Is(err, ErrPasswordChangeRequired) {
+		t.Errorf("Authenticate() returns error %v, should be %s", err, ErrPasswordChangeRequired)
+	}
+
+	if err = aU.SetPassword("a@b.c", pwd); err != nil {
+		t.Fatalf("SetPassword() returns an error: %s", err.Error())
+	}
+	if u, err = aU.Authenticate("a@b.c", pwd); err != nil {
+		t.Errorf("Authenticate() after SetPassword() returns an error: %s", err.Error())
+	} else if u.MustChangePassword() || time.Since(u.PasswordChanged()) > time.Minute {
+		t.Errorf("SetPassword() doesn't record the password change")
+	}
+}
+
+func TestAccountExpiry(t *testing.T) {
+	pwd := "a@pNn00tm13s"
+	hash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash(pwd)
+	if err != nil {
+		t.Fatalf("Hash() returns an error: %s", err.Error())
+	}
+
+	aU, err := ParseAll("a@b.c;" + hash + ";1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"d@e.f;" + hash + ";2;1;D;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"g@h.i;" + hash + ";3;1;G;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"j@k.l;" + hash + ";4;1;J;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+
+	now := time.Now()
+	expiries := map[int]time.Time{
+		1: now.Add(-time.Hour),
+		2: now.Add(48 * time.Hour),
+		3: now.Add(24 * time.Hour),
+	}
+	for id, exp := range expiries {
+		if err = aU.SetExpiry(id, exp); err != nil {
+			t.Fatalf("SetExpiry() returns an error: %s", err.Error())
+		}
+	}
+
+	// the expiry times should survive writing and reading
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	if aU, err = ParseAll(s); err != nil {
+		t.Fatalf("ParseAll(%q) returns an error: %s", s, err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+
+	_, err = aU.Authenticate("a@b.c", pwd)
+	if !errors.Is(err, ErrAccountExpired) || !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Authenticate() returns error %v, should be %s", err, ErrAccountExpired)
+	}
+	if got, want := err.Error(), ErrAuthenticationFailed.Error(); got != want {
+		t.Errorf("Authenticate() returns message %q, should be %q", got, want)
+	}
+	u, _ := aU.Get(1)
+	if got := u.Status(); got != StatusExpired {
+		t.Errorf("Status() returns %s, should be %s", got, StatusExpired)
+	}
+	if err = u.ValidatePassword(pwd); !errors.Is(err, ErrAccountExpired) {
+		t.Errorf("ValidatePassword() returns error %v, should be %s", err, ErrAccountExpired)
+	}
+
+	if _, err = aU.Authenticate("d@e.f", pwd); err != nil {
+		t.Errorf("Authenticate() returns an error: %s", err.Error())
+	}
+
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{time.Hour, ""},
+		{36 * time.Hour, "3"},
+		{72 * time.Hour, "3,2"},
+	}
+
+	for _, tst := range tests {
+		ids := []int{}
+		for _, u := range aU.ExpiringWithin(tst.d) {
+			ids = append(ids, u.UserId())
+		}
+		if got := intsString(ids); got != tst.want {
+			t.Errorf("ExpiringWithin(%s) returns users [%s], should be [%s]", tst.d, got, tst.want)
+		}
+	}
+}
@@ -5,11 +5,124 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base32"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
 )
 
+// containerMark starts an encrypted container. It can't be mistaken for the
+// base32 encoded data of the legacy format, which only holds upper case
+// letters, digits and padding characters.
+const containerMark = "$users-aead$"
+
+// containerVersion is the version of the container format written by en().
+const containerVersion = 1
+
+// scrypt parameters for deriving a key from a passphrase.
+const (
+	scryptLogN    = 15 // CPU/memory cost as a power of two
+	scryptR       = 8  // block size
+	scryptP       = 1  // parallelisation
+	scryptKeyLen  = 32 // length of the derived key
+	scryptSaltLen = 16 // length of the random salt
+)
+
+// header holds the parameters stored in the header of an encrypted
+// container. The header is formatted as containerMark followed by
+// "name=value" pairs, each terminated by a "$".
+type header struct {
+	kdf     string // key derivation function, empty when a raw key is used
+	kid     string // id of the key used for encryption, optional
+	logN    int    // scrypt CPU/memory cost as a power of two
+	p       int    // scrypt parallelisation
+	r       int    // scrypt block size
+	salt    []byte // salt for the key derivation
+	version int    // version of the container format
+}
+
+// Keyring holds a set of keys for encrypting and decrypting users files. The
+// map key is the key id.
+type Keyring map[string][]byte
+
+// parseContainer splits an encrypted container in its header and its
+// payload. It returns the header both as a string and parsed.
+func parseContainer(s string) (string, header, []byte, error) {
+	h := header{}
+
+	i := strings.LastIndex(s, "$")
+	sH, sP := s[:i+1], strings.TrimSpace(s[i+1:])
+
+	params := strings.Split(strings.TrimSuffix(strings.TrimPrefix(sH, containerMark), "$"), "$")
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+
+		var err error
+		switch name {
+		case "v":
+			h.version, err = strconv.Atoi(value)
+		case "kdf":
+			h.kdf = value
+		case "kid":
+			h.kid = value
+		case "ln":
+			h.logN, err = strconv.Atoi(value)
+		case "r":
+			h.r, err = strconv.Atoi(value)
+		case "p":
+			h.p, err = strconv.Atoi(value)
+		case "salt":
+			h.salt, err = base64.RawStdEncoding.DecodeString(value)
+		}
+		if err != nil {
+			return sH, h, nil, fmt.Errorf("%w: invalid header parameter %q", ErrDecryption, param)
+		}
+	}
+
+	if h.version != containerVersion {
+		return sH, h, nil, fmt.Errorf("%w: unsupported version %d", ErrDecryption, h.version)
+	}
+
+	payload, err := base32.StdEncoding.DecodeString(sP)
+	if err != nil {
+		return sH, h, nil, fmt.Errorf("%w: %w", ErrDecryption, err)
+	}
+
+	return sH, h, payload, nil
+}
+
+// String returns the header as it is stored in front of the payload.
+func (h header) String() string {
+	s := fmt.Sprintf("%sv=%d$", containerMark, h.version)
+	if h.kid != "" {
+		s += fmt.Sprintf("kid=%s$", h.kid)
+	}
+	if h.kdf != "" {
+		s += fmt.Sprintf("kdf=%s$ln=%d$r=%d$p=%d$salt=%s$", h.kdf, h.logN, h.r, h.p,
+			base64.RawStdEncoding.EncodeToString(h.salt))
+	}
+	return s
+}
+
+// deriveKey derives a key from passphrase using the key derivation function
+// and its parameters in h.
+func (h header) deriveKey(passphrase string) ([]byte, error) {
+	if h.kdf != "scrypt" {
+		return nil, fmt.Errorf("%w: unsupported key derivation function %q",
+			ErrDecryption, h.kdf)
+	}
+	if err := checkScryptParams(h.logN, h.r, h.p); err != nil {
+		return nil, fmt.Errorf("%w: invalid scrypt parameters: %w", ErrDecryption, err)
+	}
+
+	return scrypt.Key([]byte(passphrase), h.salt, 1<<h.logN, h.r, h.p, scryptKeyLen)
+}
+
 // testKey tests if the key has a correct length. If not, it returns an error.
 func testKey(key []byte) (err error) {
 	switch l := len(key); l {
@@ -20,37 +133,143 @@ func testKey(key []byte) (err error) {
 	return
 }
 
-// en encrypts a string with key and then encodes it into a
-// string using a base32 format. The key must have a length of
-// 16, 24, or 32 bytes
-func en(s string, key []byte) (string, error) {
+// newAEAD returns an AES-GCM AEAD for key. The key must have a length of
+// 16, 24, or 32 bytes.
+func newAEAD(key []byte) (cipher.AEAD, error) {
 	if err := testKey(key); err != nil {
-		return "", err
+		return nil, err
 	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// the initial vector `iv` is put in front of the cipher text
-	iv := make([]byte, aes.BlockSize)
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+	return cipher.NewGCM(block)
+}
+
+// en encrypts a string with key using AES-GCM and returns it as a container:
+// a header followed by the base32 encoded nonce and cipher text. The header
+// is authenticated together with the cipher text. The key must have a length
+// of 16, 24, or 32 bytes.
+func en(s string, key []byte) (string, error) {
+	return seal(s, key, header{version: containerVersion})
+}
+
+// enKeyId encrypts a string with key like en() does and stores the key id
+// kid in the header of the container. A key id must not be empty or hold a
+// "$".
+func enKeyId(s string, kid string, key []byte) (string, error) {
+	if kid == "" || strings.Contains(kid, "$") {
+		return "", fmt.Errorf("invalid key id %q", kid)
+	}
+
+	return seal(s, key, header{kid: kid, version: containerVersion})
+}
+
+// enPassphrase encrypts a string like en() does, with a key derived from
+// passphrase using scrypt and a random salt. The salt and the scrypt
+// parameters are stored in the header of the container.
+func enPassphrase(s string, passphrase string) (string, error) {
+	h := header{
+		kdf:     "scrypt",
+		logN:    scryptLogN,
+		r:       scryptR,
+		p:       scryptP,
+		salt:    make([]byte, scryptSaltLen),
+		version: containerVersion,
+	}
+	if _, err := io.ReadFull(rand.Reader, h.salt); err != nil {
 		return "", err
 	}
 
-	stream := cipher.NewOFB(block, iv)
-	cr := make([]byte, len(s))
-	stream.XORKeyStream(cr, []byte(s))
-	cr = append(iv, cr...)
+	key, err := h.deriveKey(passphrase)
+	if err != nil {
+		return "", err
+	}
 
-	return base32.StdEncoding.EncodeToString(cr), nil
+	return seal(s, key, h)
 }
 
-// de returns the decrypted string from a base32 encoded and
-// with key encrypted string. The key must have a length of
-// 16, 24, or 32 bytes.
+// de returns the decrypted string from a container as returned by en(). If
+// the key is wrong or the container has been tampered with, ErrDecryption
+// will be returned. Data encrypted in the legacy format, without a header,
+// will be decrypted by deOFB(). The key must have a length of 16, 24, or 32
+// bytes.
 func de(s string, key []byte) (string, error) {
+	if !strings.HasPrefix(s, containerMark) {
+		return deOFB(s, key)
+	}
+
+	sH, _, payload, err := parseContainer(s)
+	if err != nil {
+		return "", err
+	}
+
+	return open(sH, payload, key)
+}
+
+// dePassphrase returns the decrypted string from a container as returned by
+// enPassphrase(). The key is derived from passphrase with the parameters
+// stored in the header of the container.
+func dePassphrase(s string, passphrase string) (string, error) {
+	if !strings.HasPrefix(s, containerMark) {
+		return "", fmt.Errorf("%w: not encrypted with a passphrase", ErrDecryption)
+	}
+
+	sH, h, payload, err := parseContainer(s)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := h.deriveKey(passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	return open(sH, payload, key)
+}
+
+// deKeyring returns the decrypted string from a container as returned by
+// enKeyId(), using the key with the key id stored in its header. For a
+// container without a key id, all keys are tried in the order of their ids.
+func deKeyring(s string, keys Keyring) (string, error) {
+	if !strings.HasPrefix(s, containerMark) {
+		return "", fmt.Errorf("%w: no key id found", ErrDecryption)
+	}
+
+	sH, h, payload, err := parseContainer(s)
+	if err != nil {
+		return "", err
+	}
+
+	if h.kid != "" {
+		key, found := keys[h.kid]
+		if !found {
+			return "", fmt.Errorf("%w: unknown key id %q", ErrDecryption, h.kid)
+		}
+		return open(sH, payload, key)
+	}
+
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		if plain, err := open(sH, payload, keys[id]); err == nil {
+			return plain, nil
+		}
+	}
+	return "", ErrDecryption
+}
+
+// deOFB returns the decrypted string from a base32 encoded and with key
+// encrypted string using AES in OFB mode, the legacy format. As this format
+// isn't authenticated, a wrong key will go unnoticed. The key must have a
+// length of 16, 24, or 32 bytes.
+func deOFB(s string, key []byte) (string, error) {
 	if err := testKey(key); err != nil {
 		return "", err
 	}
@@ -75,3 +294,43 @@ func de(s string, key []byte) (string, error) {
 
 	return string(plain), nil
 }
+
+// open decrypts and authenticates payload, the nonce followed by the cipher
+// text, that was sealed with key under header sH.
+func open(sH string, payload, key []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	n := aead.NonceSize()
+	if len(payload) < n {
+		return "", fmt.Errorf("%w: missing nonce", ErrDecryption)
+	}
+
+	plain, err := aead.Open(nil, payload[:n], payload[n:], []byte(sH))
+	if err != nil {
+		return "", ErrDecryption
+	}
+
+	return string(plain), nil
+}
+
+// seal encrypts s with key and returns the container holding h and the
+// result.
+func seal(s string, key []byte, h header) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sH := h.String()
+	payload := aead.Seal(nonce, nonce, []byte(s), []byte(sH))
+
+	return sH + base32.StdEncoding.EncodeToString(payload), nil
+}
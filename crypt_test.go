@@ -1,6 +1,35 @@
 package users
 
-import "testing"
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// enOFB encrypts a string in the legacy format.
+func enOFB(s string, key []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return "", err
+	}
+
+	stream := cipher.NewOFB(block, iv)
+	cr := make([]byte, len(s))
+	stream.XORKeyStream(cr, []byte(s))
+	cr = append(iv, cr...)
+
+	return base32.StdEncoding.EncodeToString(cr), nil
+}
 
 func TestCrypt(t *testing.T) {
 	key := []byte("is this a good secret key or not")
@@ -26,3 +55,66 @@ non proident, sunt in culpa qui officia deserunt mollit anim id est laborum.
 		t.Errorf("decoded string not equal to origanal string:\n%s and \n%s", u, s)
 	}
 }
+
+func TestCryptErrors(t *testing.T) {
+	key := []byte("is this a good secret key or not")
+	s := "a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n"
+
+	e, err := en(s, key)
+	if err != nil {
+		t.Fatalf("en() returns an error: %s", err)
+	}
+
+	// flip a character in the payload
+	i := len(e) - 10
+	c := "A"
+	if e[i:i+1] == c {
+		c = "B"
+	}
+	tampered := e[:i] + c + e[i+1:]
+
+	tests := []struct {
+		s   string
+		key []byte
+		err error
+	}{
+		{e, key, nil},
+		{e, []byte("is this a good secret key or no?"), ErrDecryption},
+		{tampered, key, ErrDecryption},
+		{strings.Replace(e, "v=1", "v=2", 1), key, ErrDecryption},
+		{e[:len(containerMark)+5], key, ErrDecryption},
+	}
+
+	for _, tst := range tests {
+		got, err := de(tst.s, tst.key)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil {
+			if len(sE1) > 0 {
+				t.Errorf("de(%q) returns error %s, should be %s", tst.s, sE1, sE2)
+			}
+		} else if got != s {
+			t.Errorf("de(%q) returns %q, should be %q", tst.s, got, s)
+		}
+	}
+}
+
+func TestCryptLegacy(t *testing.T) {
+	key := []byte("is this a good secret key or not")
+	s := "a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n"
+
+	e, err := enOFB(s, key)
+	if err != nil {
+		t.Fatalf("enOFB() returns an error: %s", err)
+	}
+
+	got, err := de(e, key)
+	if err != nil {
+		t.Fatalf("de() returns an error: %s", err)
+	}
+	if got != s {
+		t.Errorf("de() returns %q, should be %q", got, s)
+	}
+
+	if _, err = de(e, key[:10]); err == nil || errors.Is(err, ErrDecryption) {
+		t.Errorf("de() with a short key returns error %v, should be a key length error", err)
+	}
+}
@@ -0,0 +1,225 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// backupPath returns the path of the i-th generation backup of the file at path.
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// coder decrypts or encrypts the contents of a users file.
+type coder func(s string) (string, error)
+
+// keyDecoder returns a coder decrypting with key. When key is empty, the
+// contents are left untouched.
+func keyDecoder(key []byte) coder {
+	return func(s string) (string, error) {
+		if len(key) == 0 {
+			return s, nil
+		}
+		return de(s, key)
+	}
+}
+
+// keyEncoder returns a coder encrypting with key. When key is empty, the
+// contents are left untouched.
+func keyEncoder(key []byte) coder {
+	return func(s string) (string, error) {
+		if len(key) == 0 {
+			return s, nil
+		}
+		return en(s, key)
+	}
+}
+
+// modifyLocked reads the user data from the file at path, calls f to modify
+// them and writes them back, while holding an exclusive lock on the file.
+func modifyLocked(path string, dec, enc coder, f func(aU *AllUsers) error) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	aU, err := read(path, dec)
+	if err != nil {
+		return err
+	}
+
+	if err = f(aU); err != nil {
+		return err
+	}
+
+	return aU.write(path, enc)
+}
+
+// read reads the user data from the file at path and decrypts them with dec,
+// without locking the file. If the file doesn't exists, an empty instance of
+// AllUsers will be returned.
+func read(path string, dec coder) (*AllUsers, error) {
+	s, err := readString(path, dec)
+	if err != nil {
+		return &AllUsers{}, err
+	}
+
+	return ParseAll(s)
+}
+
+// readLocked reads the user data from the file at path and decrypts them with
+// dec, while holding a shared lock on the file.
+func readLocked(path string, dec coder) (*AllUsers, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	unlock, err := lockFile(path, false)
+	if err != nil {
+		return &AllUsers{}, err
+	}
+	defer unlock()
+
+	return read(path, dec)
+}
+
+// readString reads the file at path and decrypts its contents with dec,
+// without locking the file. A file that doesn't exist reads as an empty string.
+func readString(path string, dec coder) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+
+	return dec(string(b))
+}
+
+// rotateBackups shifts the numbered backups of the file at path one
+// generation, drops the oldest one and makes the current file the first
+// generation. At most n generations are kept.
+func rotateBackups(path string, n int) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	for i := n - 1; i > 0; i-- {
+		err := os.Rename(backupPath(path, i), backupPath(path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	bPath := backupPath(path, 1)
+	if err := os.Remove(bPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// the current file must stay in place, so link it instead of renaming it
+	if err := os.Link(path, bPath); err == nil {
+		return nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(bPath, b, 0600)
+}
+
+// writeFile replaces the contents of the file at path by b. It first writes
+// b into a temporary file in the same directory and then renames it, so the
+// file at path will always be complete, even after a crash. When backups is
+// larger than zero, that many generations of the previous contents will be
+// kept in files with the generation number appended to path.
+func writeFile(path string, b []byte, backups int) error {
+	dir := filepath.Dir(path)
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath) // only succeeds when the rename didn't take place
+
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if backups > 0 {
+		if err = rotateBackups(path, backups); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// write encrypts the user data with enc and stores them in the file at path,
+// without locking the file. The user data are marked as not being modified,
+// unless writing fails.
+func (aU *AllUsers) write(path string, enc coder) (err error) {
+	aU.mu.Lock()
+	s, err := aU.string()
+	backups := aU.backups
+	aU.dirty = false
+	aU.mu.Unlock()
+
+	defer func() {
+		if err != nil {
+			aU.mu.Lock()
+			aU.dirty = true
+			aU.mu.Unlock()
+		}
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	if s, err = enc(s); err != nil {
+		return err
+	}
+
+	return writeFile(path, []byte(s), backups)
+}
+
+// writeLocked encrypts the user data with enc and stores them in the file at
+// path, while holding an exclusive lock on the file.
+func (aU *AllUsers) writeLocked(path string, enc coder) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return aU.write(path, enc)
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package users
+
+// syncDir does nothing, as directories can't be synced on this platform.
+func syncDir(path string) error {
+	return nil
+}
+
+// lockFile does nothing, as advisory file locks aren't supported on this
+// platform. Access is only serialised within a single process.
+func lockFile(path string, exclusive bool) (unlock func() error, err error) {
+	return func() error { return nil }, nil
+}
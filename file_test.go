@@ -0,0 +1,269 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadModifyWrite(t *testing.T) {
+	path := filepath.Join("testing", ".rmw.txt")
+	os.Remove(path)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			err := ReadModifyWrite(path, nil, func(aU *AllUsers) error {
+				u, err := New(fmt.Sprintf("u%d@b.c", i), "U", []int{})
+				if err != nil {
+					return err
+				}
+				return aU.Put(&u)
+			})
+			if err != nil {
+				t.Errorf("ReadModifyWrite() returns an error: %s", err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	errAbort := errors.New("abort")
+	err := ReadModifyWrite(path, nil, func(aU *AllUsers) error {
+		if err := aU.Remove(1); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Errorf("ReadModifyWrite() returns error %v, should be %s", err, errAbort)
+	}
+
+	aU, err := Read(path, nil)
+	if err != nil {
+		t.Fatalf("Read() returns an error: %s", err.Error())
+	}
+	if l := len(aU.usersById); l != 10 {
+		t.Errorf("Read() returns %d users, should be 10", l)
+	}
+}
+
+func TestWriteBackups(t *testing.T) {
+	path := filepath.Join("testing", ".backups.txt")
+	for i := 1; i <= 4; i++ {
+		os.Remove(backupPath(path, i))
+	}
+	os.Remove(path)
+
+	aU := &AllUsers{}
+	aU.SetBackups(2)
+
+	names := []string{"A", "B", "C", "D"}
+	for i, name := range names {
+		u, err := New("a@b.c", name, []int{})
+		if err != nil {
+			t.Fatalf("New() returns an error: %s", err.Error())
+		}
+		if i == 0 {
+			err = aU.Put(&u)
+		} else {
+			err = aU.SetName("a@b.c", name)
+		}
+		if err != nil {
+			t.Fatalf("Put() or SetName() returns an error: %s", err.Error())
+		}
+
+		if !aU.IsDirty() {
+			t.Errorf("IsDirty() returns false after a modification")
+		}
+		if err = aU.Write(path, nil); err != nil {
+			t.Fatalf("Write() returns an error: %s", err.Error())
+		}
+		if aU.IsDirty() {
+			t.Errorf("IsDirty() returns true after Write()")
+		}
+	}
+
+	tests := []struct {
+		path string
+		name string
+	}{
+		{path, "D"},
+		{backupPath(path, 1), "C"},
+		{backupPath(path, 2), "B"},
+	}
+
+	for _, tst := range tests {
+		aU, err := Read(tst.path, nil)
+		if err != nil {
+			t.Fatalf("Read(%q) returns an error: %s", tst.path, err.Error())
+		}
+		if u, err := aU.Get("a@b.c"); err != nil {
+			t.Errorf("Get() returns an error: %s", err.Error())
+		} else if got := u.Name(); got != tst.name {
+			t.Errorf("Name() from %q returns %q, should be %q", tst.path, got, tst.name)
+		}
+	}
+
+	if _, err := os.Stat(backupPath(path, 3)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat(%q) returns error %v, should be %s",
+			backupPath(path, 3), err, os.ErrNotExist)
+	}
+
+	entries, err := os.ReadDir("testing")
+	if err != nil {
+		t.Fatalf("ReadDir() returns an error: %s", err.Error())
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			t.Errorf("temporary file %q is left behind", e.Name())
+		}
+	}
+}
+
+func TestReadAndWriteWithPassphrase(t *testing.T) {
+	path := filepath.Join("testing", ".passphrase.txt")
+	os.Remove(path)
+
+	aU1, err := ParseAll("a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	passphrase := "correct horse battery staple"
+	if err = aU1.WriteWithPassphrase(path, passphrase); err != nil {
+		t.Fatalf("WriteWithPassphrase() returns an error: %s", err.Error())
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() returns an error: %s", err.Error())
+	}
+	if s := string(b); !strings.Contains(s, "$kdf=scrypt$") || !strings.Contains(s, "$salt=") {
+		t.Errorf("file doesn't hold the key derivation parameters: %q", s)
+	}
+
+	aU2, err := ReadWithPassphrase(path, passphrase)
+	if err != nil {
+		t.Fatalf("ReadWithPassphrase() returns an error: %s", err.Error())
+	}
+	if _, err = aU2.Get("a@b.c"); err != nil {
+		t.Errorf("Get() returns an error: %s", err.Error())
+	}
+
+	if _, err = ReadWithPassphrase(path, passphrase+"!"); !errors.Is(err, ErrDecryption) {
+		t.Errorf("ReadWithPassphrase() with a wrong passphrase returns error %v, should be %s",
+			err, ErrDecryption)
+	}
+
+	if _, err = Read(path, []byte("is this a good secret key or not")); !errors.Is(err, ErrDecryption) {
+		t.Errorf("Read() with a key returns error %v, should be %s", err, ErrDecryption)
+	}
+
+	// tampered headers
+	tests := []struct {
+		old, new string
+	}{
+		{"$r=8$", "$r=0$"},
+		{"$p=1$", "$p=0$"},
+		{"$r=8$p=1$", "$r=-1$p=-1$"},
+		{"$r=8$p=1$", "$r=32768$p=32768$"},
+		{"$ln=15$", "$ln=0$"},
+		{"$ln=15$", "$ln=31$"},
+		{"$ln=15$", "$ln=22$"},
+		{"$kdf=scrypt$", "$kdf=bcrypt$"},
+	}
+	for _, tst := range tests {
+		s := string(b)
+		if !strings.Contains(s, tst.old) {
+			t.Fatalf("file doesn't hold %q: %q", tst.old, s)
+		}
+		if err = os.WriteFile(path, []byte(strings.Replace(s, tst.old, tst.new, 1)), 0600); err != nil {
+			t.Fatalf("WriteFile() returns an error: %s", err.Error())
+		}
+		if _, err = ReadWithPassphrase(path, passphrase); !errors.Is(err, ErrDecryption) {
+			t.Errorf("ReadWithPassphrase() with %q returns error %v, should be %s", tst.new, err, ErrDecryption)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	path := filepath.Join("testing", ".rekey.txt")
+	os.Remove(path)
+
+	key1 := []byte("is this a good secret key or not")
+	key2 := []byte("this may be a better secret key!")
+	keys := Keyring{"k1": key1, "k2": key2}
+
+	aU, err := ParseAll("a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	if err = aU.Write(path, key1); err != nil {
+		t.Fatalf("Write() returns an error: %s", err.Error())
+	}
+
+	if err = Rekey(path, key1, key2); err != nil {
+		t.Fatalf("Rekey() returns an error: %s", err.Error())
+	}
+	if _, err = Read(path, key1); !errors.Is(err, ErrDecryption) {
+		t.Errorf("Read() with the old key returns error %v, should be %s", err, ErrDecryption)
+	}
+	if _, err = Read(path, key2); err != nil {
+		t.Errorf("Read() with the new key returns an error: %s", err.Error())
+	}
+
+	// a file without key id
+	if _, err = ReadWithKeyring(path, keys); err != nil {
+		t.Errorf("ReadWithKeyring() returns an error: %s", err.Error())
+	}
+
+	if err = RekeyWithKeyring(path, keys, "k1"); err != nil {
+		t.Fatalf("RekeyWithKeyring() returns an error: %s", err.Error())
+	}
+
+	tests := []struct {
+		keys Keyring
+		err  error
+	}{
+		{keys, nil},
+		{Keyring{"k1": key1}, nil},
+		{Keyring{"k2": key2}, ErrDecryption},
+		{Keyring{"k1": key2}, ErrDecryption},
+	}
+
+	for _, tst := range tests {
+		_, err := ReadWithKeyring(path, tst.keys)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil {
+			if len(sE1) > 0 {
+				t.Errorf("ReadWithKeyring() returns error %s, should be %s", sE1, sE2)
+			}
+		}
+	}
+
+	if err = aU.WriteWithKeyId(path, "k$", key1); err == nil {
+		t.Errorf("WriteWithKeyId() with an invalid key id returns no error")
+	}
+	if err = RekeyWithKeyring(path, keys, "k3"); err == nil {
+		t.Errorf("RekeyWithKeyring() with an unknown key id returns no error")
+	}
+
+	// a missing file isn't treated as an empty one
+	missing := filepath.Join("testing", ".missing.txt")
+	os.Remove(missing)
+	if err = Rekey(missing, key1, key2); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Rekey() for a missing file returns error %v, should be %s", err, os.ErrNotExist)
+	}
+	if err = RekeyWithKeyring(missing, keys, "k1"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("RekeyWithKeyring() for a missing file returns error %v, should be %s", err, os.ErrNotExist)
+	}
+	if _, err = os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Rekey() creates a missing file")
+	}
+}
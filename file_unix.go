@@ -0,0 +1,57 @@
+//go:build unix
+
+package users
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an advisory lock on the lock file that belongs to the file
+// at path, i.e. path with ".lock" appended. The lock is exclusive or shared,
+// and it serialises access across processes. It blocks until the lock is
+// acquired and returns a function to release it. When the directory of path
+// doesn't exist, there is nothing to guard and no lock will be acquired.
+func lockFile(path string, exclusive bool) (unlock func() error, err error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return func() error { return nil }, nil
+		}
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() error {
+		defer f.Close()
+		return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}, nil
+}
+
+// syncDir commits the directory entries of the directory at path to stable
+// storage.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
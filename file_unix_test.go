@@ -0,0 +1,46 @@
+//go:build unix
+
+package users
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join("testing", ".lock.txt")
+	os.Remove(path)
+
+	// the lock is held by "another process"
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		t.Fatalf("lockFile() returns an error: %s", err.Error())
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := Read(path, nil)
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Read() doesn't wait for the exclusive lock to be released")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err = unlock(); err != nil {
+		t.Fatalf("unlock() returns an error: %s", err.Error())
+	}
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Read() returns an error: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Read() doesn't acquire the lock after it has been released")
+	}
+}
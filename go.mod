@@ -3,3 +3,5 @@ module github.com/FrankStorbeck/users
 go 1.21.6
 
 require golang.org/x/crypto v0.18.0
+
+require golang.org/x/sys v0.16.0 // indirect
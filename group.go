@@ -0,0 +1,510 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Group holds the data of a group, like an entry of /etc/group. A group can
+// contain other groups: the members of those are members of the group as well.
+type Group struct {
+	created     time.Time // time of creation
+	description string    // description of the group
+	id          int       // identifier, must be non negative
+	modified    time.Time // last modification time
+	name        string    // name, unique for all groups
+	subGroupIds []int     // groups contained in this group
+}
+
+// groupCache caches the closures of nested groups. It has a mutex of its own,
+// so it can be filled while holding a read lock of AllUsers.
+type groupCache struct {
+	closures map[int][]int // the group and the groups containing it, the key is the group id
+	mu       sync.Mutex    // guards closures and parents
+	parents  map[int][]int // groups containing a group directly, the key is the group id
+}
+
+// Created returns the time of creation.
+func (g Group) Created() time.Time {
+	return g.created
+}
+
+// Description returns the description.
+func (g Group) Description() string {
+	return g.description
+}
+
+// Id returns the group id.
+func (g Group) Id() int {
+	return g.id
+}
+
+// Modified returns the last modification time.
+func (g Group) Modified() time.Time {
+	return g.modified
+}
+
+// Name returns the name.
+func (g Group) Name() string {
+	return g.name
+}
+
+// SubGroupIds returns the group id's of the groups contained in the group.
+func (g Group) SubGroupIds() []int {
+	return slices.Clone(g.subGroupIds)
+}
+
+// String returns the group line for a file. It holds the following fields
+// separated by semi colons: the group id, the name, the description, the time
+// of creation and the last modification time, followed by the optional field
+// for the group id's of the groups contained in the group, separated by
+// comma's.
+func (g Group) String() string {
+	return fmt.Sprintf("%s%d;%s;%s;%s;%s", groupMark, g.id, g.name, g.description,
+		g.created.Format(time.RFC3339), g.modified.Format(time.RFC3339)) +
+		optionalFields(intsString(g.subGroupIds))
+}
+
+// clone returns a copy of g that doesn't share any data with g.
+func (g Group) clone() *Group {
+	c := g
+	c.subGroupIds = slices.Clone(g.subGroupIds)
+	return &c
+}
+
+// AddSubGroup makes the group sub a sub group of the group parent, each given
+// by its group name or group id, so the members of sub become members of
+// parent as well. A group can't contain itself, not even indirectly;
+// ErrGroupCycle will be returned then.
+func (aU *AllUsers) AddSubGroup(parent, sub interface{}) error {
+	return aU.updateGroup(parent, func(g *Group) error {
+		s, found := selectGroup(aU, sub)
+		if !found {
+			return fmt.Errorf("%w: %v", ErrNoSuchGroup, sub)
+		}
+		if slices.Contains(g.subGroupIds, s.id) {
+			return nil
+		}
+		if slices.Contains(aU.closure(g.id), s.id) {
+			return fmt.Errorf("%w: %s contains %s", ErrGroupCycle, s.name, g.name)
+		}
+
+		g.subGroupIds = append(g.subGroupIds, s.id)
+		slices.Sort(g.subGroupIds)
+		aU.groupCache.invalidate()
+		return nil
+	})
+}
+
+// AddUserToGroup adds the group with the provided group name or group id to
+// the groups of the user with the provided user name or user id.
+func (aU *AllUsers) AddUserToGroup(uNameOrId, gNameOrId interface{}) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		g, found := selectGroup(aU, gNameOrId)
+		if !found {
+			return fmt.Errorf("%w: %v", ErrNoSuchGroup, gNameOrId)
+		}
+		if u.IsInGroup(g.id) {
+			return nil
+		}
+		return u.SetGroups(append(slices.Clone(u.groupIds), g.id))
+	})
+}
+
+// CheckGroups checks whether the group id's of all users belong to groups
+// created by CreateGroup(). It returns an error listing the missing ones for
+// each user, for which errors.Is() reports ErrNoSuchGroup.
+func (aU *AllUsers) CheckGroups() error {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	errs := []error{}
+	for _, u := range aU.sort() {
+		if err := aU.checkGroupIds(u.groupIds, true); err != nil {
+			errs = append(errs, fmt.Errorf("%w for user %s", err, u.userName))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CreateGroup creates a group with group id id. The id and the name must be
+// unique. A name can't be empty or hold white space, semi colons, colons or
+// comma's, and a description can't hold semi colons or line breaks.
+func (aU *AllUsers) CreateGroup(id int, name, description string) error {
+	if id < 0 {
+		return fmt.Errorf("%w: (%d)", ErrInvalidGroupId, id)
+	}
+	name = strings.TrimSpace(name)
+	if err := validateName(name, ErrInvalidGroupName); err != nil {
+		return err
+	}
+	if err := validateDescription(description); err != nil {
+		return err
+	}
+
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	if _, found := selectGroup(aU, id); found {
+		return fmt.Errorf("%w: %d", ErrGroupExists, id)
+	}
+	if _, found := selectGroup(aU, name); found {
+		return fmt.Errorf("%w: %s", ErrGroupExists, name)
+	}
+
+	g := &Group{id: id, name: name, description: description, created: time.Now()}
+	g.modified = g.created
+	if aU.groups == nil {
+		aU.groups = make(map[int]*Group)
+	}
+	aU.groups[id] = g
+	aU.groupCache.invalidate()
+	aU.dirty = true
+	return nil
+}
+
+// EffectiveGroups returns the group id's of the groups the user with the
+// provided user name or user id is a member of, directly or through nested
+// groups, in ascending order. See User.IsMemberOf(). The closures of nested
+// groups are cached until groups change.
+func (aU *AllUsers) EffectiveGroups(uNameOrId interface{}) ([]int, error) {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	u, found := selectUser(aU, uNameOrId)
+	if !found {
+		return nil, ErrNoSuchUser
+	}
+	return aU.effectiveGroups(u.groupIds), nil
+}
+
+// Group fetches a copy of the group with the provided group name or group id.
+func (aU *AllUsers) Group(gNameOrId interface{}) (*Group, error) {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	g, found := selectGroup(aU, gNameOrId)
+	if !found {
+		return &Group{}, fmt.Errorf("%w: %v", ErrNoSuchGroup, gNameOrId)
+	}
+	return g.clone(), nil
+}
+
+// Groups returns copies of all groups, ordered by group id.
+func (aU *AllUsers) Groups() []*Group {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	groups := make([]*Group, 0, len(aU.groups))
+	for _, id := range aU.groupIds() {
+		groups = append(groups, aU.groups[id].clone())
+	}
+	return groups
+}
+
+// RemoveGroup removes the group with the provided group name or group id. A
+// group that still has members can't be removed, ErrGroupInUse will be
+// returned then.
+func (aU *AllUsers) RemoveGroup(gNameOrId interface{}) error {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	g, found := selectGroup(aU, gNameOrId)
+	if !found {
+		return fmt.Errorf("%w: %v", ErrNoSuchGroup, gNameOrId)
+	}
+	if len(aU.usersByGroup[g.id]) > 0 {
+		return fmt.Errorf("%w: %s", ErrGroupInUse, g.name)
+	}
+
+	delete(aU.groups, g.id)
+	for _, parent := range aU.groups {
+		parent.subGroupIds = slices.DeleteFunc(parent.subGroupIds, func(id int) bool {
+			return id == g.id
+		})
+	}
+	aU.groupCache.invalidate()
+	aU.dirty = true
+	return nil
+}
+
+// RemoveSubGroup removes the group sub from the sub groups of the group
+// parent, each given by its group name or group id.
+func (aU *AllUsers) RemoveSubGroup(parent, sub interface{}) error {
+	return aU.updateGroup(parent, func(g *Group) error {
+		s, found := selectGroup(aU, sub)
+		if !found {
+			return fmt.Errorf("%w: %v", ErrNoSuchGroup, sub)
+		}
+
+		g.subGroupIds = slices.DeleteFunc(g.subGroupIds, func(id int) bool {
+			return id == s.id
+		})
+		aU.groupCache.invalidate()
+		return nil
+	})
+}
+
+// RemoveUserFromGroup removes the group with the provided group name or group
+// id from the groups of the user with the provided user name or user id.
+func (aU *AllUsers) RemoveUserFromGroup(uNameOrId, gNameOrId interface{}) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		g, found := selectGroup(aU, gNameOrId)
+		if !found {
+			return fmt.Errorf("%w: %v", ErrNoSuchGroup, gNameOrId)
+		}
+		if !u.IsInGroup(g.id) {
+			return nil
+		}
+		return u.SetGroups(slices.DeleteFunc(slices.Clone(u.groupIds), func(id int) bool {
+			return id == g.id
+		}))
+	})
+}
+
+// SetGroupDescription sets the description of the group with the provided
+// group name or group id.
+func (aU *AllUsers) SetGroupDescription(gNameOrId interface{}, description string) error {
+	if err := validateDescription(description); err != nil {
+		return err
+	}
+
+	return aU.updateGroup(gNameOrId, func(g *Group) error {
+		g.description = description
+		return nil
+	})
+}
+
+// SetGroupName sets the name of the group with the provided group name or
+// group id. See CreateGroup() for valid names.
+func (aU *AllUsers) SetGroupName(gNameOrId interface{}, name string) error {
+	name = strings.TrimSpace(name)
+	if err := validateName(name, ErrInvalidGroupName); err != nil {
+		return err
+	}
+
+	return aU.updateGroup(gNameOrId, func(g *Group) error {
+		if other, found := selectGroup(aU, name); found && other != g {
+			return fmt.Errorf("%w: %s", ErrGroupExists, name)
+		}
+		g.name = name
+		return nil
+	})
+}
+
+// checkGroupIds checks whether groupIds belong to existing groups. As long as
+// no groups have been created, group id's aren't checked, unless always is
+// true.
+func (aU *AllUsers) checkGroupIds(groupIds []int, always bool) error {
+	if len(aU.groups) == 0 && !always {
+		return nil
+	}
+
+	missing := []string{}
+	for _, id := range groupIds {
+		if _, found := aU.groups[id]; !found {
+			missing = append(missing, strconv.Itoa(id))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrNoSuchGroup, strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// closure returns the group id's of the group with group id id and of all
+// groups containing it, directly or indirectly, in ascending order. The caller
+// must hold the lock of aU.
+func (aU *AllUsers) closure(id int) []int {
+	aU.groupCache.mu.Lock()
+	defer aU.groupCache.mu.Unlock()
+
+	return aU.closureLocked(id)
+}
+
+// closureLocked returns the closure of a group like closure() does, while
+// the lock of the cache is held.
+func (aU *AllUsers) closureLocked(id int) []int {
+	c := &aU.groupCache
+	if ids, found := c.closures[id]; found {
+		return ids
+	}
+
+	if c.parents == nil {
+		c.parents = make(map[int][]int)
+		for _, g := range aU.groups {
+			for _, sub := range g.subGroupIds {
+				c.parents[sub] = append(c.parents[sub], g.id)
+			}
+		}
+	}
+
+	ids := []int{id}
+	for i := 0; i < len(ids); i++ {
+		for _, parent := range c.parents[ids[i]] {
+			// a file might hold a cycle, so check for groups seen before
+			if !slices.Contains(ids, parent) {
+				ids = append(ids, parent)
+			}
+		}
+	}
+	slices.Sort(ids)
+
+	if c.closures == nil {
+		c.closures = make(map[int][]int)
+	}
+	c.closures[id] = ids
+	return ids
+}
+
+// effectiveGroups returns the group id's of groupIds together with those of
+// all groups containing them, in ascending order. The caller must hold the
+// lock of aU.
+func (aU *AllUsers) effectiveGroups(groupIds []int) []int {
+	aU.groupCache.mu.Lock()
+	defer aU.groupCache.mu.Unlock()
+
+	ids := []int{}
+	for _, id := range groupIds {
+		ids = append(ids, aU.closureLocked(id)...)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+// groupIds returns the group id's of all groups in ascending order.
+func (aU *AllUsers) groupIds() []int {
+	ids := make([]int, 0, len(aU.groups))
+	for id := range aU.groups {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// groupStrings returns the group lines, ordered by group id.
+func (aU *AllUsers) groupStrings() []string {
+	lines := []string{}
+	for _, id := range aU.groupIds() {
+		lines = append(lines, aU.groups[id].String())
+	}
+	return lines
+}
+
+// invalidate empties the cache, after groups have changed.
+func (c *groupCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closures = nil
+	c.parents = nil
+}
+
+// parseGroup parses a group line as returned by Group.String() and stores it
+// in aU.
+func (aU *AllUsers) parseGroup(s string) error {
+	fields := strings.Split(strings.TrimPrefix(s, groupMark), ";")
+	if l := len(fields); l < 5 {
+		return fmt.Errorf("%w, less than 6 fields found for group: %d",
+			ErrMissingData, l+1)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	g := &Group{name: fields[1], description: fields[2]}
+
+	var err error
+	g.id, err = strconv.Atoi(fields[0])
+	if err != nil || g.id < 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidGroupId, fields[0])
+	}
+	if err = validateName(g.name, ErrInvalidGroupName); err != nil {
+		return fmt.Errorf("%w for group %d", err, g.id)
+	}
+
+	if g.created, err = time.Parse(time.RFC3339, fields[3]); err != nil {
+		return fmt.Errorf("%w (creation) for group %d: %w", ErrInvalidTime, g.id, err)
+	}
+	if g.modified, err = time.Parse(time.RFC3339, fields[4]); err != nil {
+		return fmt.Errorf("%w (modification) for group %d: %w", ErrInvalidTime, g.id, err)
+	}
+
+	if len(fields) > 5 {
+		for _, sId := range strings.Split(fields[5], ",") {
+			if sId = strings.TrimSpace(sId); sId == "" {
+				continue
+			}
+			id, err := strconv.Atoi(sId)
+			if err != nil || id < 0 {
+				return fmt.Errorf("%w (sub group) for group %d: %q", ErrInvalidGroupId, g.id, sId)
+			}
+			g.subGroupIds = append(g.subGroupIds, id)
+		}
+		slices.Sort(g.subGroupIds)
+	}
+
+	if _, found := selectGroup(aU, g.id); found {
+		return fmt.Errorf("%w: %d", ErrGroupExists, g.id)
+	}
+	if _, found := selectGroup(aU, g.name); found {
+		return fmt.Errorf("%w: %s", ErrGroupExists, g.name)
+	}
+
+	if aU.groups == nil {
+		aU.groups = make(map[int]*Group)
+	}
+	aU.groups[g.id] = g
+	aU.groupCache.invalidate()
+	return nil
+}
+
+// selectGroup returns the group with the group name or group id sOrI.
+func selectGroup(aU *AllUsers, sOrI interface{}) (*Group, bool) {
+	switch key := sOrI.(type) {
+	case string:
+		key = strings.TrimSpace(key)
+		for _, g := range aU.groups {
+			if g.name == key {
+				return g, true
+			}
+		}
+	case int:
+		if g, found := aU.groups[key]; found {
+			return g, true
+		}
+	}
+	return &Group{}, false
+}
+
+// updateGroup calls f for the group with the provided group name or group id
+// while holding the lock of aU.
+func (aU *AllUsers) updateGroup(gNameOrId interface{}, f func(g *Group) error) error {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	g, found := selectGroup(aU, gNameOrId)
+	if !found {
+		return fmt.Errorf("%w: %v", ErrNoSuchGroup, gNameOrId)
+	}
+
+	if err := f(g); err != nil {
+		return err
+	}
+	g.modified = time.Now()
+	aU.dirty = true
+	return nil
+}
+
+// validateDescription returns an error if description can't be stored.
+func validateDescription(description string) error {
+	if strings.ContainsAny(description, ";\r\n") {
+		return fmt.Errorf("%w (description): %q", ErrInvalidField, description)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package users
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	aU, err := ParseAll("a@b.c;*;1;1,7;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"d@e.f;*;2;1;D;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	// no groups yet, so group id's aren't checked
+	if err = aU.SetGroups(2, []int{1, 5}); err != nil {
+		t.Errorf("SetGroups() without groups returns an error: %s", err.Error())
+	}
+	if err = aU.CheckGroups(); !errors.Is(err, ErrNoSuchGroup) {
+		t.Errorf("CheckGroups() returns error %v, should be %s", err, ErrNoSuchGroup)
+	}
+
+	createTests := []struct {
+		id          int
+		name        string
+		description string
+		err         error
+	}{
+		{1, "staff", "All staff", nil},
+		{5, "admins", "", nil},
+		{7, "ops", "Operations; on call", ErrInvalidField},
+		{7, "on call", "", ErrInvalidGroupName},
+		{7, "", "", ErrInvalidGroupName},
+		{-1, "minus", "", ErrInvalidGroupId},
+		{1, "other", "", ErrGroupExists},
+		{8, "admins", "", ErrGroupExists},
+		{7, "ops", "Operations", nil},
+	}
+	for _, tst := range createTests {
+		err := aU.CreateGroup(tst.id, tst.name, tst.description)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("CreateGroup(%d, %q) returns error %q, should be %q", tst.id, tst.name, sE1, sE2)
+		}
+	}
+	if err = aU.CheckGroups(); err != nil {
+		t.Errorf("CheckGroups() returns an error: %s", err.Error())
+	}
+
+	if err = aU.SetGroups(2, []int{1, 3}); !errors.Is(err, ErrNoSuchGroup) {
+		t.Errorf("SetGroups() returns error %v, should be %s", err, ErrNoSuchGroup)
+	}
+	u, _ := New("g@h.i", "G", []int{3})
+	if err = aU.Put(&u); !errors.Is(err, ErrNoSuchGroup) {
+		t.Errorf("Put() returns error %v, should be %s", err, ErrNoSuchGroup)
+	}
+
+	if err = aU.SetGroupName("ops", "operations"); err != nil {
+		t.Errorf("SetGroupName() returns an error: %s", err.Error())
+	}
+	if err = aU.SetGroupName(7, "staff"); !errors.Is(err, ErrGroupExists) {
+		t.Errorf("SetGroupName() returns error %v, should be %s", err, ErrGroupExists)
+	}
+	if err = aU.SetGroupDescription("admins", "Administrators"); err != nil {
+		t.Errorf("SetGroupDescription() returns an error: %s", err.Error())
+	}
+
+	// the groups survive writing and parsing
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	if aU, err = ParseAll(s); err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	groups := aU.Groups()
+	names := []string{}
+	for _, g := range groups {
+		names = append(names, g.Name())
+	}
+	if !slices.Equal(names, []string{"staff", "admins", "operations"}) {
+		t.Errorf("Groups() returns groups %v", names)
+	}
+	g, err := aU.Group("admins")
+	if err != nil {
+		t.Fatalf("Group() returns an error: %s", err.Error())
+	}
+	if g.Id() != 5 || g.Description() != "Administrators" || g.Modified().Before(g.Created()) {
+		t.Errorf("Group() returns %s", g.String())
+	}
+	if _, err = aU.Group(3); !errors.Is(err, ErrNoSuchGroup) {
+		t.Errorf("Group() returns error %v, should be %s", err, ErrNoSuchGroup)
+	}
+
+	if err = aU.AddUserToGroup("d@e.f", "operations"); err != nil {
+		t.Errorf("AddUserToGroup() returns an error: %s", err.Error())
+	}
+	if err = aU.AddUserToGroup("d@e.f", "unknown"); !errors.Is(err, ErrNoSuchGroup) {
+		t.Errorf("AddUserToGroup() returns error %v, should be %s", err, ErrNoSuchGroup)
+	}
+	if err = aU.RemoveUserFromGroup(2, 1); err != nil {
+		t.Errorf("RemoveUserFromGroup() returns an error: %s", err.Error())
+	}
+	if u, _ := aU.Get(2); !slices.Equal(u.GroupIds(), []int{5, 7}) {
+		t.Errorf("user is in groups %v, should be [5 7]", u.GroupIds())
+	}
+
+	if err = aU.RemoveGroup("admins"); !errors.Is(err, ErrGroupInUse) {
+		t.Errorf("RemoveGroup() returns error %v, should be %s", err, ErrGroupInUse)
+	}
+	if err = aU.RemoveUserFromGroup(2, "admins"); err != nil {
+		t.Errorf("RemoveUserFromGroup() returns an error: %s", err.Error())
+	}
+	if err = aU.RemoveGroup("admins"); err != nil {
+		t.Errorf("RemoveGroup() returns an error: %s", err.Error())
+	}
+	if _, err = aU.Group(5); !errors.Is(err, ErrNoSuchGroup) {
+		t.Errorf("Group() after RemoveGroup() returns error %v, should be %s", err, ErrNoSuchGroup)
+	}
+}
+
+func TestParseGroup(t *testing.T) {
+	tests := []struct {
+		s   string
+		err error
+	}{
+		{"g;1;staff;All staff;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z", nil},
+		{"g;1;staff;;2023-11-24T15:38:00Z", ErrMissingData},
+		{"g;x;staff;;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z", ErrInvalidGroupId},
+		{"g;1;st,aff;;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z", ErrInvalidGroupName},
+		{"g;1;staff;;today;2023-12-05T08:14:00Z", ErrInvalidTime},
+		{"g;1;staff;;2023-11-24T15:38:00Z;today", ErrInvalidTime},
+		{"g;1;staff;;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;2,3", nil},
+		{"g;1;staff;;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;2,x", ErrInvalidGroupId},
+		{"g;1;staff;;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+			"g;2;staff;;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z", ErrGroupExists},
+	}
+
+	for _, tst := range tests {
+		_, err := ParseAll(tst.s + "\n")
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("ParseAll(%q) returns error %q, should be %q", tst.s, sE1, sE2)
+		}
+	}
+}
+
+func TestNestedGroups(t *testing.T) {
+	aU, err := ParseAll("a@b.c;*;1;3;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"d@e.f;*;2;2;D;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"g;1;company;;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;2\n" +
+		"g;2;sales;;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"g;3;team;;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"g;4;other;;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	if err = aU.AddSubGroup("sales", "team"); err != nil {
+		t.Fatalf("AddSubGroup() returns an error: %s", err.Error())
+	}
+
+	tests := []struct {
+		parent, sub interface{}
+		err         error
+	}{
+		{"team", "company", ErrGroupCycle},
+		{"team", "team", ErrGroupCycle},
+		{"team", "sales", ErrGroupCycle},
+		{"team", 5, ErrNoSuchGroup},
+		{5, "team", ErrNoSuchGroup},
+		{"company", "team", nil},
+	}
+	for _, tst := range tests {
+		err := aU.AddSubGroup(tst.parent, tst.sub)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("AddSubGroup(%v, %v) returns error %q, should be %q", tst.parent, tst.sub, sE1, sE2)
+		}
+	}
+
+	groups, err := aU.EffectiveGroups(1)
+	if err != nil {
+		t.Fatalf("EffectiveGroups() returns an error: %s", err.Error())
+	}
+	if !slices.Equal(groups, []int{1, 2, 3}) {
+		t.Errorf("EffectiveGroups() returns %v, should be [1 2 3]", groups)
+	}
+
+	u, _ := aU.Get(1)
+	if !u.IsMemberOf(1) || !u.IsMemberOf(2) || u.IsMemberOf(4) || u.IsInGroup(1) {
+		t.Errorf("IsMemberOf() doesn't resolve nested groups")
+	}
+
+	// the cache is invalidated when groups change
+	if err = aU.RemoveSubGroup("sales", "team"); err != nil {
+		t.Fatalf("RemoveSubGroup() returns an error: %s", err.Error())
+	}
+	if err = aU.AddSubGroup("other", "sales"); err != nil {
+		t.Fatalf("AddSubGroup() returns an error: %s", err.Error())
+	}
+	if groups, _ = aU.EffectiveGroups(1); !slices.Equal(groups, []int{1, 3}) {
+		t.Errorf("EffectiveGroups() returns %v, should be [1 3]", groups)
+	}
+	if groups, _ = aU.EffectiveGroups(2); !slices.Equal(groups, []int{1, 2, 4}) {
+		t.Errorf("EffectiveGroups() returns %v, should be [1 2 4]", groups)
+	}
+
+	p := &Policy{}
+	p.SetRole("seller", []string{"sell"})
+	p.AssignRoleToGroup("seller", 4)
+	aU.SetPolicy(p)
+	if !aU.Can(2, "sell") || aU.Can(1, "sell") {
+		t.Errorf("Can() doesn't resolve nested groups")
+	}
+
+	// the sub groups survive writing and parsing
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	if aU, err = ParseAll(s); err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	if g, _ := aU.Group("company"); !slices.Equal(g.SubGroupIds(), []int{2, 3}) {
+		t.Errorf("SubGroupIds() returns %v, should be [2 3]", g.SubGroupIds())
+	}
+
+	if err = aU.RemoveGroup("other"); err != nil {
+		t.Fatalf("RemoveGroup() returns an error: %s", err.Error())
+	}
+	if groups, _ = aU.EffectiveGroups(2); !slices.Equal(groups, []int{1, 2}) {
+		t.Errorf("EffectiveGroups() after RemoveGroup() returns %v, should be [1 2]", groups)
+	}
+}
+
+func TestMembersOf(t *testing.T) {
+	aU, err := ParseAll("a@b.c;*;3;1,2;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"d@e.f;*;1;1;D;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"g@h.i;*;2;2;G;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	ids := func(groupId int) []int {
+		ids := []int{}
+		for _, u := range aU.MembersOf(groupId) {
+			ids = append(ids, u.UserId())
+		}
+		return ids
+	}
+
+	if got := ids(1); !slices.Equal(got, []int{1, 3}) {
+		t.Errorf("MembersOf(1) returns users %v, should be [1 3]", got)
+	}
+	if got := ids(5); len(got) != 0 {
+		t.Errorf("MembersOf(5) returns users %v, should be none", got)
+	}
+
+	u, _ := New("j@k.l", "J", []int{2})
+	aU.Put(&u)
+	aU.SetGroups(1, []int{2, 5})
+	aU.SetUserName(3, "x@y.z")
+	aU.Remove(2)
+
+	tests := []struct {
+		groupId int
+		userIds []int
+	}{
+		{1, []int{3}},
+		{2, []int{1, 3, 4}},
+		{5, []int{1}},
+	}
+	for _, tst := range tests {
+		if got := ids(tst.groupId); !slices.Equal(got, tst.userIds) {
+			t.Errorf("MembersOf(%d) returns users %v, should be %v", tst.groupId, got, tst.userIds)
+		}
+	}
+	if members := aU.MembersOf(2); members[1].UserName() != "x@y.z" {
+		t.Errorf("MembersOf() returns user %q, should be %q", members[1].UserName(), "x@y.z")
+	}
+}
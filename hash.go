@@ -0,0 +1,435 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// defaultHasher is used for hashing new passwords when no other Hasher has
+// been set.
+var defaultHasher Hasher = BcryptHasher{}
+
+// saltLen is the length of the random salts generated by the hashers.
+const saltLen = 16
+
+// Upper bounds for the parameters taken from a stored hash or an encrypted
+// file, so corrupt data can't make comparing or decrypting exhaust memory or
+// take forever.
+const (
+	argon2MaxMemory     = 1 << 20    // memory in KiB, 1 GiB
+	argon2MaxTime       = 64         // number of passes
+	pbkdf2MaxIterations = 10_000_000 // number of iterations
+	pbkdf2MaxKeyLen     = 64         // key length in bytes
+	scryptMaxLogN       = 24         // CPU/memory cost as a power of two
+	scryptMaxMemory     = 1 << 30    // memory in bytes, 128 * r * N
+)
+
+// Hasher hashes passwords and validates them against their hashes. The
+// hashes are encoded in the PHC string format, except for bcrypt that uses
+// its own format.
+type Hasher interface {
+	// Compare returns nil if hash is a hash of plainPassword.
+	Compare(hash, plainPassword string) error
+
+	// Hash returns a hash of plainPassword.
+	Hash(plainPassword string) (string, error)
+
+	// NeedsRehash returns true if hash hasn't been generated by this Hasher
+	// with its current parameters.
+	NeedsRehash(hash string) bool
+}
+
+// Argon2idHasher hashes passwords with Argon2id. Fields with a zero value
+// get a default value.
+type Argon2idHasher struct {
+	Memory  uint32 // memory in KiB, default 64 MiB
+	Threads uint8  // degree of parallelism, default 4
+	Time    uint32 // number of passes, default 3
+	KeyLen  uint32 // length of the hash in bytes, default 32
+}
+
+// BcryptHasher hashes passwords with bcrypt. As bcrypt only uses the first 72
+// bytes of a password, longer passwords are refused.
+type BcryptHasher struct {
+	Cost int // cost, default 12
+}
+
+// PBKDF2Hasher hashes passwords with PBKDF2 using HMAC-SHA256. Fields with a
+// zero value get a default value.
+type PBKDF2Hasher struct {
+	Iterations int // number of iterations, default 600000
+	KeyLen     int // length of the hash in bytes, default 32
+}
+
+// ScryptHasher hashes passwords with scrypt. Fields with a zero value get a
+// default value.
+type ScryptHasher struct {
+	LogN   int // CPU/memory cost as a power of two, default 15
+	R      int // block size, default 8
+	P      int // parallelisation, default 1
+	KeyLen int // length of the hash in bytes, default 32
+}
+
+// Compare returns nil if hash is an Argon2id hash of plainPassword. The
+// parameters are taken from hash.
+func (Argon2idHasher) Compare(hash, plainPassword string) error {
+	id, params, salt, key, err := parsePHC(hash)
+	if err != nil {
+		return err
+	}
+	if id != "argon2id" || params["v"] != strconv.Itoa(argon2.Version) {
+		return fmt.Errorf("%w: %q", ErrUnknownHash, id)
+	}
+
+	m, errM := strconv.ParseUint(params["m"], 10, 32)
+	t, errT := strconv.ParseUint(params["t"], 10, 32)
+	p, errP := strconv.ParseUint(params["p"], 10, 8)
+	if err = errors.Join(errM, errT, errP, checkArgon2Params(m, t, p)); err != nil {
+		return fmt.Errorf("invalid argon2id parameters in hash: %w", err)
+	}
+
+	other := argon2.IDKey([]byte(plainPassword), salt, uint32(t), uint32(m), uint8(p),
+		uint32(len(key)))
+	return compareKeys(key, other)
+}
+
+// Hash returns an Argon2id hash of plainPassword.
+func (h Argon2idHasher) Hash(plainPassword string) (string, error) {
+	h = h.withDefaults()
+
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(plainPassword), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s", argon2.Version,
+		h.Memory, h.Time, h.Threads, encodeSaltAndKey(salt, key)), nil
+}
+
+// NeedsRehash returns true if hash isn't an Argon2id hash generated with the
+// parameters of h.
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	h = h.withDefaults()
+
+	id, params, _, key, err := parsePHC(hash)
+	return err != nil || id != "argon2id" ||
+		params["v"] != strconv.Itoa(argon2.Version) ||
+		params["m"] != strconv.FormatUint(uint64(h.Memory), 10) ||
+		params["t"] != strconv.FormatUint(uint64(h.Time), 10) ||
+		params["p"] != strconv.FormatUint(uint64(h.Threads), 10) ||
+		len(key) != int(h.KeyLen)
+}
+
+// withDefaults returns h with default values for fields with a zero value.
+func (h Argon2idHasher) withDefaults() Argon2idHasher {
+	if h.Memory == 0 {
+		h.Memory = 64 * 1024
+	}
+	if h.Threads == 0 {
+		h.Threads = 4
+	}
+	if h.Time == 0 {
+		h.Time = 3
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = 32
+	}
+	return h
+}
+
+// Compare returns nil if hash is a bcrypt hash of plainPassword.
+func (BcryptHasher) Compare(hash, plainPassword string) error {
+	if len(plainPassword) > 72 {
+		return bcrypt.ErrPasswordTooLong
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(plainPassword))
+}
+
+// Hash returns a bcrypt hash of plainPassword.
+func (h BcryptHasher) Hash(plainPassword string) (string, error) {
+	h = h.withDefaults()
+
+	b, err := bcrypt.GenerateFromPassword([]byte(plainPassword), h.Cost)
+	return string(b), err
+}
+
+// NeedsRehash returns true if hash isn't a bcrypt hash generated with the cost
+// of h.
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	h = h.withDefaults()
+
+	if hr, err := hasherFor(hash); err != nil || hr != (BcryptHasher{}) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.Cost
+}
+
+// withDefaults returns h with default values for fields with a zero value.
+func (h BcryptHasher) withDefaults() BcryptHasher {
+	if h.Cost == 0 {
+		h.Cost = 12
+	}
+	return h
+}
+
+// Compare returns nil if hash is a PBKDF2-SHA256 hash of plainPassword. The
+// parameters are taken from hash.
+func (PBKDF2Hasher) Compare(hash, plainPassword string) error {
+	id, params, salt, key, err := parsePHC(hash)
+	if err != nil {
+		return err
+	}
+	if id != "pbkdf2-sha256" {
+		return fmt.Errorf("%w: %q", ErrUnknownHash, id)
+	}
+
+	i, err := strconv.Atoi(params["i"])
+	if err = errors.Join(err, checkPBKDF2Params(i, len(key))); err != nil {
+		return fmt.Errorf("invalid pbkdf2 parameters in hash: %w", err)
+	}
+
+	return compareKeys(key, pbkdf2.Key([]byte(plainPassword), salt, i, len(key), sha256.New))
+}
+
+// Hash returns a PBKDF2-SHA256 hash of plainPassword.
+func (h PBKDF2Hasher) Hash(plainPassword string) (string, error) {
+	h = h.withDefaults()
+
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+
+	key := pbkdf2.Key([]byte(plainPassword), salt, h.Iterations, h.KeyLen, sha256.New)
+	return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s", h.Iterations, encodeSaltAndKey(salt, key)), nil
+}
+
+// NeedsRehash returns true if hash isn't a PBKDF2-SHA256 hash generated with
+// the parameters of h.
+func (h PBKDF2Hasher) NeedsRehash(hash string) bool {
+	h = h.withDefaults()
+
+	id, params, _, key, err := parsePHC(hash)
+	return err != nil || id != "pbkdf2-sha256" ||
+		params["i"] != strconv.Itoa(h.Iterations) || len(key) != h.KeyLen
+}
+
+// withDefaults returns h with default values for fields with a zero value.
+func (h PBKDF2Hasher) withDefaults() PBKDF2Hasher {
+	if h.Iterations == 0 {
+		h.Iterations = 600000
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = 32
+	}
+	return h
+}
+
+// Compare returns nil if hash is a scrypt hash of plainPassword. The
+// parameters are taken from hash.
+func (ScryptHasher) Compare(hash, plainPassword string) error {
+	id, params, salt, key, err := parsePHC(hash)
+	if err != nil {
+		return err
+	}
+	if id != "scrypt" {
+		return fmt.Errorf("%w: %q", ErrUnknownHash, id)
+	}
+
+	ln, errLn := strconv.Atoi(params["ln"])
+	r, errR := strconv.Atoi(params["r"])
+	p, errP := strconv.Atoi(params["p"])
+	if err = errors.Join(errLn, errR, errP, checkScryptParams(ln, r, p)); err != nil {
+		return fmt.Errorf("invalid scrypt parameters in hash: %w", err)
+	}
+
+	other, err := scrypt.Key([]byte(plainPassword), salt, 1<<ln, r, p, len(key))
+	if err != nil {
+		return err
+	}
+	return compareKeys(key, other)
+}
+
+// Hash returns a scrypt hash of plainPassword.
+func (h ScryptHasher) Hash(plainPassword string) (string, error) {
+	h = h.withDefaults()
+
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(plainPassword), salt, 1<<h.LogN, h.R, h.P, h.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s", h.LogN, h.R, h.P,
+		encodeSaltAndKey(salt, key)), nil
+}
+
+// NeedsRehash returns true if hash isn't a scrypt hash generated with the
+// parameters of h.
+func (h ScryptHasher) NeedsRehash(hash string) bool {
+	h = h.withDefaults()
+
+	id, params, _, key, err := parsePHC(hash)
+	return err != nil || id != "scrypt" ||
+		params["ln"] != strconv.Itoa(h.LogN) || params["r"] != strconv.Itoa(h.R) ||
+		params["p"] != strconv.Itoa(h.P) || len(key) != h.KeyLen
+}
+
+// withDefaults returns h with default values for fields with a zero value.
+func (h ScryptHasher) withDefaults() ScryptHasher {
+	if h.LogN == 0 {
+		h.LogN = 15
+	}
+	if h.R == 0 {
+		h.R = 8
+	}
+	if h.P == 0 {
+		h.P = 1
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = 32
+	}
+	return h
+}
+
+// compareKeys compares the keys in constant time. It returns nil when they
+// are equal.
+func compareKeys(key, other []byte) error {
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+	return nil
+}
+
+// checkArgon2Params returns an error if the Argon2id parameters memory m,
+// time t and parallelism p can't be used or exceed the upper bounds.
+func checkArgon2Params(m, t, p uint64) error {
+	switch {
+	case t < 1 || t > argon2MaxTime:
+		return fmt.Errorf("time %d out of range", t)
+	case p < 1:
+		return fmt.Errorf("parallelism %d less than 1", p)
+	case m > argon2MaxMemory:
+		return fmt.Errorf("memory %d KiB too large", m)
+	}
+	return nil
+}
+
+// checkPBKDF2Params returns an error if the PBKDF2 iteration count i or key
+// length keyLen can't be used or exceed the upper bounds.
+func checkPBKDF2Params(i, keyLen int) error {
+	switch {
+	case i < 1 || i > pbkdf2MaxIterations:
+		return fmt.Errorf("iteration count %d out of range", i)
+	case keyLen < 1 || keyLen > pbkdf2MaxKeyLen:
+		return fmt.Errorf("key length %d out of range", keyLen)
+	}
+	return nil
+}
+
+// checkScryptParams returns an error if the scrypt parameters logN, r and p
+// can't be used or exceed the upper bounds.
+func checkScryptParams(logN, r, p int) error {
+	switch {
+	case logN < 1 || logN > scryptMaxLogN:
+		return fmt.Errorf("cost %d out of range", logN)
+	case r < 1 || p < 1:
+		return fmt.Errorf("block size %d or parallelisation %d less than 1", r, p)
+	case int64(r)*int64(p) >= 1<<30:
+		return fmt.Errorf("block size %d times parallelisation %d too large", r, p)
+	case int64(r)*128<<logN > scryptMaxMemory:
+		return fmt.Errorf("block size %d and cost %d need too much memory", r, logN)
+	}
+	return nil
+}
+
+// compareHash returns nil if hash is a hash of plainPassword. The algorithm
+// is detected from the prefix of hash.
+func compareHash(hash, plainPassword string) error {
+	h, err := hasherFor(hash)
+	if err != nil {
+		return err
+	}
+	return h.Compare(hash, plainPassword)
+}
+
+// encodeSaltAndKey returns the salt and the key in the format of the last
+// two fields of a PHC string.
+func encodeSaltAndKey(salt, key []byte) string {
+	return base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(key)
+}
+
+// hasherFor returns the Hasher for the algorithm used for hash, detected from
+// its prefix.
+func hasherFor(hash string) (Hasher, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"),
+		strings.HasPrefix(hash, "$2y$"):
+		return BcryptHasher{}, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2idHasher{}, nil
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		return PBKDF2Hasher{}, nil
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return ScryptHasher{}, nil
+	}
+	return nil, ErrUnknownHash
+}
+
+// newSalt returns a random salt.
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLen)
+	_, err := io.ReadFull(rand.Reader, salt)
+	return salt, err
+}
+
+// parsePHC parses a hash in the PHC string format
+// "$<id>[$v=<version>][$<param>=<value>[,<param>=<value>...]]$<salt>$<hash>".
+// The parameters, including the version, are returned in a map.
+func parsePHC(s string) (id string, params map[string]string, salt, key []byte, err error) {
+	fields := strings.Split(s, "$")
+	if len(fields) < 4 || fields[0] != "" {
+		return "", nil, nil, nil, fmt.Errorf("%w: not a PHC string", ErrUnknownHash)
+	}
+
+	id = fields[1]
+	params = make(map[string]string)
+	for _, fld := range fields[2 : len(fields)-2] {
+		for _, param := range strings.Split(fld, ",") {
+			name, value, _ := strings.Cut(param, "=")
+			params[name] = value
+		}
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(fields[len(fields)-2])
+	if err != nil {
+		return id, params, nil, nil, fmt.Errorf("invalid salt in hash: %w", err)
+	}
+	key, err = base64.RawStdEncoding.DecodeString(fields[len(fields)-1])
+	if err != nil {
+		return id, params, nil, nil, fmt.Errorf("invalid hash: %w", err)
+	}
+	if len(key) == 0 {
+		return id, params, nil, nil, errors.New("invalid hash: empty")
+	}
+
+	return id, params, salt, key, nil
+}
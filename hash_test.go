@@ -0,0 +1,195 @@
+package users
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashers(t *testing.T) {
+	tests := []struct {
+		hasher Hasher
+		prefix string
+	}{
+		{BcryptHasher{Cost: bcrypt.MinCost}, "$2a$04$"},
+		{Argon2idHasher{Memory: 1024, Time: 1, Threads: 1}, "$argon2id$v=19$m=1024,t=1,p=1$"},
+		{ScryptHasher{LogN: 10}, "$scrypt$ln=10,r=8,p=1$"},
+		{PBKDF2Hasher{Iterations: 1000}, "$pbkdf2-sha256$i=1000$"},
+	}
+
+	pwd := "a@pNn00tm13s"
+	for _, tst := range tests {
+		hash, err := tst.hasher.Hash(pwd)
+		if err != nil {
+			t.Fatalf("%T.Hash() returns an error: %s", tst.hasher, err.Error())
+		}
+		if !strings.HasPrefix(hash, tst.prefix) {
+			t.Errorf("%T.Hash() returns %q, should start with %q", tst.hasher, hash, tst.prefix)
+		}
+
+		if err = compareHash(hash, pwd); err != nil {
+			t.Errorf("compareHash(%q) returns an error: %s, should be nil", hash, err.Error())
+		}
+		if err = compareHash(hash, pwd+"_"); err == nil {
+			t.Errorf("compareHash(%q) with a wrong password returns no error", hash)
+		}
+
+		other, err := tst.hasher.Hash(pwd)
+		if err != nil {
+			t.Fatalf("%T.Hash() returns an error: %s", tst.hasher, err.Error())
+		}
+		if other == hash {
+			t.Errorf("%T.Hash() returns the same hash twice, salt isn't random", tst.hasher)
+		}
+	}
+}
+
+func TestHashErrors(t *testing.T) {
+	long := strings.Repeat("x", 73)
+	if _, err := (BcryptHasher{Cost: bcrypt.MinCost}).Hash(long); err == nil {
+		t.Errorf("BcryptHasher.Hash() with a password of 73 bytes returns no error")
+	}
+
+	hash, err := (BcryptHasher{Cost: bcrypt.MinCost}).Hash(long[:72])
+	if err != nil {
+		t.Fatalf("BcryptHasher.Hash() returns an error: %s", err.Error())
+	}
+	if err = compareHash(hash, long); err == nil {
+		t.Errorf("compareHash() with a truncated password of 73 bytes returns no error")
+	}
+
+	saltAndKey := "c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"
+	tests := []struct {
+		hash string
+		msg  string // part of the error message
+	}{
+		{"", ""},
+		{"*", ""},
+		{"$md5$abc", ""},
+		{"$argon2id$v=19$m=8,t=1,p=1$!!$!!", ""},
+		{"$argon2id$v=19$m=8,t=0,p=1$" + saltAndKey, "time 0 out of range"},
+		{"$argon2id$v=19$m=8,t=1,p=0$" + saltAndKey, "parallelism 0 less than 1"},
+		{"$argon2id$v=19$m=4194304,t=1,p=1$" + saltAndKey, "memory 4194304 KiB too large"},
+		{"$argon2id$v=19$m=8,t=100000,p=1$" + saltAndKey, "time 100000 out of range"},
+		{"$argon2id$v=19$m=x,t=1,p=1$" + saltAndKey, "invalid syntax"},
+		{"$pbkdf2-sha256$i=0$" + saltAndKey, "iteration count 0 out of range"},
+		{"$pbkdf2-sha256$i=2000000000$" + saltAndKey, "iteration count 2000000000 out of range"},
+		{"$pbkdf2-sha256$i=x$" + saltAndKey, "invalid syntax"},
+		{"$pbkdf2-sha256$i=1000$c2FsdHNhbHRzYWx0c2FsdA$" + strings.Repeat("a2V5", 30), "key length 90 out of range"},
+		{"$scrypt$ln=15,r=0,p=1$" + saltAndKey, "less than 1"},
+		{"$scrypt$ln=15,r=8,p=0$" + saltAndKey, "less than 1"},
+		{"$scrypt$ln=15,r=-8,p=-1$" + saltAndKey, "less than 1"},
+		{"$scrypt$ln=1,r=1073741824,p=1$" + saltAndKey, "too large"},
+		{"$scrypt$ln=1,r=32768,p=32768$" + saltAndKey, "too large"},
+		{"$scrypt$ln=0,r=8,p=1$" + saltAndKey, "cost 0 out of range"},
+		{"$scrypt$ln=31,r=8,p=1$" + saltAndKey, "cost 31 out of range"},
+		{"$scrypt$ln=22,r=8,p=1$" + saltAndKey, "too much memory"},
+	}
+	for _, tst := range tests {
+		err := compareHash(tst.hash, "x")
+		if err == nil {
+			t.Errorf("compareHash(%q) returns no error", tst.hash)
+		} else if msg := err.Error(); !strings.Contains(msg, tst.msg) || strings.Contains(msg, "%!") {
+			t.Errorf("compareHash(%q) returns error %q, should contain %q", tst.hash, msg, tst.msg)
+		}
+	}
+	if err := compareHash("$md5$abc", "x"); !errors.Is(err, ErrUnknownHash) {
+		t.Errorf("compareHash() returns error %v, should be %s", err, ErrUnknownHash)
+	}
+}
+
+func TestSetHasher(t *testing.T) {
+	aU, err := ParseAll("a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(PBKDF2Hasher{Iterations: 1000})
+
+	pwd := "a@pNn00tm13s"
+	if err = aU.SetPassword(1, pwd); err != nil {
+		t.Fatalf("SetPassword() returns an error: %s", err.Error())
+	}
+
+	u, err := aU.Get(1)
+	if err != nil {
+		t.Fatalf("Get() returns an error: %s", err.Error())
+	}
+	if !strings.HasPrefix(u.hashedPassword, "$pbkdf2-sha256$") {
+		t.Errorf("SetPassword() stores hash %q, should be a PBKDF2 hash", u.hashedPassword)
+	}
+	if err = u.ValidatePassword(pwd); err != nil {
+		t.Errorf("ValidatePassword() returns an error: %s", err.Error())
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	pwd := "a@pNn00tm13s"
+	bcrypt4, _ := BcryptHasher{Cost: bcrypt.MinCost}.Hash(pwd)
+	argon, _ := Argon2idHasher{Memory: 1024, Time: 1, Threads: 1}.Hash(pwd)
+	scrypt10, _ := ScryptHasher{LogN: 10}.Hash(pwd)
+	pbkdf1000, _ := PBKDF2Hasher{Iterations: 1000}.Hash(pwd)
+
+	tests := []struct {
+		hasher Hasher
+		hash   string
+		want   bool
+	}{
+		{BcryptHasher{Cost: bcrypt.MinCost}, bcrypt4, false},
+		{BcryptHasher{}, bcrypt4, true},
+		{BcryptHasher{}, argon, true},
+		{Argon2idHasher{Memory: 1024, Time: 1, Threads: 1}, argon, false},
+		{Argon2idHasher{Memory: 1024, Time: 2, Threads: 1}, argon, true},
+		{Argon2idHasher{}, bcrypt4, true},
+		{ScryptHasher{LogN: 10}, scrypt10, false},
+		{ScryptHasher{}, scrypt10, true},
+		{PBKDF2Hasher{Iterations: 1000}, pbkdf1000, false},
+		{PBKDF2Hasher{}, pbkdf1000, true},
+		{PBKDF2Hasher{}, "*", true},
+	}
+
+	for _, tst := range tests {
+		if got := tst.hasher.NeedsRehash(tst.hash); got != tst.want {
+			t.Errorf("%#v.NeedsRehash(%q) returns %t, should be %t",
+				tst.hasher, tst.hash, got, tst.want)
+		}
+	}
+}
+
+func TestAuthenticateRehash(t *testing.T) {
+	pwd := "a@pNn00tm13s"
+	hash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash(pwd)
+	if err != nil {
+		t.Fatalf("Hash() returns an error: %s", err.Error())
+	}
+
+	aU, err := ParseAll("a@b.c;" + hash + ";1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(PBKDF2Hasher{Iterations: 1000})
+
+	if _, err = aU.Authenticate("a@b.c", pwd+"_"); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Authenticate() returns error %v, should be %s", err, ErrInvalidPassword)
+	}
+
+	u, err := aU.Authenticate("a@b.c", pwd)
+	if err != nil {
+		t.Fatalf("Authenticate() returns an error: %s", err.Error())
+	}
+	if !strings.HasPrefix(u.hashedPassword, "$pbkdf2-sha256$i=1000$") {
+		t.Errorf("Authenticate() doesn't re-hash the password, hash is %q", u.hashedPassword)
+	}
+	if !u.Modified().After(time.Date(2023, time.December, 5, 8, 14, 0, 0, time.UTC)) {
+		t.Errorf("Modified() returns %s, should be updated", u.Modified().Format(time.RFC3339))
+	}
+	if !aU.IsDirty() {
+		t.Errorf("IsDirty() returns false after re-hashing")
+	}
+
+	if _, err = aU.Authenticate("a@b.c", pwd); err != nil {
+		t.Errorf("Authenticate() after re-hashing returns an error: %s", err.Error())
+	}
+}
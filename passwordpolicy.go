@@ -0,0 +1,197 @@
+package users
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy defines the requirements for new passwords. Fields with a
+// zero value don't impose a requirement, but an empty password is never
+// accepted.
+type PasswordPolicy struct {
+	MaxLength  int     // maximum number of characters
+	MinEntropy float64 // minimum estimated entropy in bits
+	MinLength  int     // minimum number of characters
+
+	RejectUserData bool // reject passwords containing the user name or name
+	RequireDigit   bool // require at least one digit
+	RequireLower   bool // require at least one lower case letter
+	RequireSymbol  bool // require at least one character that isn't a letter or digit
+	RequireUpper   bool // require at least one upper case letter
+
+	denylist map[string]bool // lower case passwords that are refused
+}
+
+// PolicyError is returned when a password doesn't meet a PasswordPolicy. It
+// lists every requirement that failed. errors.Is() reports ErrPasswordPolicy
+// as well as each of the violations, e.g. ErrPasswordTooShort.
+type PolicyError struct {
+	Violations []error // the failed requirements
+}
+
+// Error returns a message listing all violations.
+func (e *PolicyError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Error()
+	}
+	return ErrPasswordPolicy.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns ErrPasswordPolicy and the violations.
+func (e *PolicyError) Unwrap() []error {
+	return append([]error{ErrPasswordPolicy}, e.Violations...)
+}
+
+// Check checks whether plainPassword meets the policy when it is set for u. It
+// returns nil if it does, otherwise a *PolicyError.
+func (p PasswordPolicy) Check(u User, plainPassword string) error {
+	violations := []error{}
+	if plainPassword == "" {
+		violations = append(violations, ErrPasswordEmpty)
+	}
+
+	l := len([]rune(plainPassword))
+	if p.MinLength > 0 && l < p.MinLength {
+		violations = append(violations,
+			fmt.Errorf("%w, minimum is %d characters", ErrPasswordTooShort, p.MinLength))
+	}
+	if p.MaxLength > 0 && l > p.MaxLength {
+		violations = append(violations,
+			fmt.Errorf("%w, maximum is %d characters", ErrPasswordTooLong, p.MaxLength))
+	}
+
+	lower, upper, digit, symbol := characterClasses(plainPassword)
+	if p.RequireLower && !lower {
+		violations = append(violations, ErrPasswordMissingLower)
+	}
+	if p.RequireUpper && !upper {
+		violations = append(violations, ErrPasswordMissingUpper)
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, ErrPasswordMissingDigit)
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, ErrPasswordMissingSymbol)
+	}
+
+	if e := entropy(plainPassword); p.MinEntropy > 0 && e < p.MinEntropy {
+		violations = append(violations, fmt.Errorf("%w, estimated entropy is %.0f bits, minimum is %.0f",
+			ErrPasswordTooPredictable, e, p.MinEntropy))
+	}
+
+	if p.RejectUserData && containsUserData(u, plainPassword) {
+		violations = append(violations, ErrPasswordContainsUserData)
+	}
+
+	if p.denylist[strings.ToLower(plainPassword)] {
+		violations = append(violations, ErrPasswordDenied)
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// LoadDenylist loads a list of passwords that will be refused, e.g. common or
+// breached ones, from the file at path. The file holds one password per line;
+// empty lines and lines starting with "#" are skipped. Passwords are compared
+// case insensitively. The passwords are added to those already loaded.
+func (p *PasswordPolicy) LoadDenylist(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if p.denylist == nil {
+		p.denylist = make(map[string]bool)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.denylist[strings.ToLower(line)] = true
+	}
+	return scanner.Err()
+}
+
+// characterClasses reports which classes of characters are present in s.
+func characterClasses(s string) (lower, upper, digit, symbol bool) {
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	return
+}
+
+// containsUserData returns true if plainPassword contains the user name of u,
+// the part of it before the "@", or a word of at least 3 characters of the
+// name of u, ignoring case.
+func containsUserData(u User, plainPassword string) bool {
+	pwd := strings.ToLower(plainPassword)
+
+	parts := strings.Fields(strings.ToLower(u.name))
+	if userName := strings.ToLower(u.userName); userName != "" {
+		local, _, _ := strings.Cut(userName, "@")
+		parts = append(parts, userName, local)
+	}
+
+	for _, part := range parts {
+		if len([]rune(part)) >= 3 && strings.Contains(pwd, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// entropy estimates the entropy of s in bits, as the number of characters
+// times the number of bits needed to pick each of them from the pool formed by
+// the classes of characters present in s. Repeated characters only count once,
+// to penalise passwords like "aaaaaaaa".
+func entropy(s string) float64 {
+	lower, upper, digit, symbol := characterClasses(s)
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	distinct := map[rune]bool{}
+	n := 0
+	for _, r := range s {
+		if !distinct[r] {
+			distinct[r] = true
+			n++
+		}
+	}
+	return float64(n) * math.Log2(float64(pool))
+}
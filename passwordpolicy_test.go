@@ -0,0 +1,205 @@
+package users
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	path := filepath.Join("testing", ".denylist.txt")
+	if err := os.WriteFile(path, []byte("# common passwords\n\nPassword1!\nletmein\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() returns an error: %s", err.Error())
+	}
+	defer os.Remove(path)
+
+	p := PasswordPolicy{
+		MaxLength:      20,
+		MinEntropy:     40,
+		MinLength:      8,
+		RejectUserData: true,
+		RequireDigit:   true,
+		RequireLower:   true,
+		RequireSymbol:  true,
+		RequireUpper:   true,
+	}
+	if err := p.LoadDenylist(path); err != nil {
+		t.Fatalf("LoadDenylist() returns an error: %s", err.Error())
+	}
+
+	u, _ := New("john.doe@b.c", "John Doe", []int{1})
+
+	tests := []struct {
+		password   string
+		violations []error
+	}{
+		{"a@pNn00tm13s", nil},
+		{"", []error{ErrPasswordEmpty, ErrPasswordTooShort, ErrPasswordMissingLower,
+			ErrPasswordMissingUpper, ErrPasswordMissingDigit, ErrPasswordMissingSymbol,
+			ErrPasswordTooPredictable}},
+		{"aB1!", []error{ErrPasswordTooShort, ErrPasswordTooPredictable}},
+		{"a@pNn00tm13s_a@pNn00tm13s", []error{ErrPasswordTooLong}},
+		{"apnn00tm13s!", []error{ErrPasswordMissingUpper}},
+		{"aaaaaaaaA1!", []error{ErrPasswordTooPredictable}},
+		{"x@JOHN.doe9", []error{ErrPasswordContainsUserData}},
+		{"x@Doe9JohnQ", []error{ErrPasswordContainsUserData}},
+		{"pASSWORD1!", []error{ErrPasswordDenied}},
+	}
+
+	for _, tst := range tests {
+		err := p.Check(u, tst.password)
+		if tst.violations == nil {
+			if err != nil {
+				t.Errorf("Check(%q) returns an error: %s", tst.password, err.Error())
+			}
+			continue
+		}
+
+		var pErr *PolicyError
+		if !errors.As(err, &pErr) || !errors.Is(err, ErrPasswordPolicy) {
+			t.Errorf("Check(%q) returns error %v, should be a *PolicyError", tst.password, err)
+			continue
+		}
+		if len(pErr.Violations) != len(tst.violations) {
+			t.Errorf("Check(%q) returns %d violations (%s), should be %d",
+				tst.password, len(pErr.Violations), err.Error(), len(tst.violations))
+		}
+		for _, v := range tst.violations {
+			if !errors.Is(err, v) {
+				t.Errorf("Check(%q) returns error %q, should include %q", tst.password, err.Error(), v.Error())
+			}
+		}
+	}
+
+	if err := p.LoadDenylist(filepath.Join("testing", ".nonexisting.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadDenylist() returns error %v, should be %s", err, os.ErrNotExist)
+	}
+}
+
+func TestSetPasswordPolicy(t *testing.T) {
+	aU, err := ParseAll("a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+
+	if err = aU.SetPassword(1, ""); !errors.Is(err, ErrPasswordEmpty) {
+		t.Errorf("SetPassword() returns error %v, should be %s", err, ErrPasswordEmpty)
+	}
+	if aU.IsDirty() {
+		t.Errorf("SetPassword() with a refused password marks the user data as modified")
+	}
+
+	aU.SetPasswordPolicy(PasswordPolicy{MinLength: 12})
+	tests := []struct {
+		uNameOrId interface{}
+		password  string
+		err       error
+	}{
+		{1, "a@pNn00tm13s", nil},
+		{"a@b.c", "short", ErrPasswordTooShort},
+		{2, "a@pNn00tm13s", ErrNoSuchUser},
+	}
+
+	for _, tst := range tests {
+		err := aU.SetPassword(tst.uNameOrId, tst.password)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("SetPassword(%v, %q) returns error %q, should be %q",
+				tst.uNameOrId, tst.password, sE1, sE2)
+		}
+	}
+
+	if _, err = aU.Authenticate("a@b.c", "a@pNn00tm13s"); err != nil {
+		t.Errorf("Authenticate() returns an error: %s", err.Error())
+	}
+
+	// the policy set doesn't change when the policy passed is modified later
+	path := filepath.Join("testing", ".denylist2.txt")
+	if err := os.WriteFile(path, []byte("password\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() returns an error: %s", err.Error())
+	}
+	defer os.Remove(path)
+
+	var p PasswordPolicy
+	if err := p.LoadDenylist(path); err != nil {
+		t.Fatalf("LoadDenylist() returns an error: %s", err.Error())
+	}
+	aU.SetPasswordPolicy(p)
+	if err := os.WriteFile(path, []byte("a@pNn00tm14s\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() returns an error: %s", err.Error())
+	}
+	if err := p.LoadDenylist(path); err != nil {
+		t.Fatalf("LoadDenylist() returns an error: %s", err.Error())
+	}
+	if err = aU.SetPassword(1, "a@pNn00tm14s"); err != nil {
+		t.Errorf("SetPassword() returns an error: %s", err.Error())
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	aU, err := ParseAll("a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+	aU.SetPasswordHistory(2)
+
+	tests := []struct {
+		password string
+		err      error
+	}{
+		{"pwd1", nil},
+		{"pwd1", ErrPasswordReused},
+		{"pwd2", nil},
+		{"pwd1", ErrPasswordReused},
+		{"pwd3", nil},
+		{"pwd1", ErrPasswordReused},
+		{"pwd4", nil},
+		{"pwd1", nil}, // no longer in the history
+		{"pwd2", nil},
+	}
+
+	for i, tst := range tests {
+		err := aU.SetPassword(1, tst.password)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("%d: SetPassword(%q) returns error %q, should be %q", i, tst.password, sE1, sE2)
+		}
+	}
+
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	aU, err = ParseAll(s)
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	u, _ := aU.Get(1)
+	if l := len(u.pwHistory); l != 2 {
+		t.Errorf("history holds %d hashes after parsing, should be 2", l)
+	}
+	if !u.isReused("pwd4", 2) || !u.isReused("pwd1", 2) || u.isReused("pwd3", 2) {
+		t.Errorf("history after parsing doesn't hold the right passwords")
+	}
+	if u.isReused("pwd4", 1) {
+		t.Errorf("isReused() checks more passwords than the size of the history")
+	}
+
+	// a smaller history applies at once
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+	aU.SetPasswordHistory(1)
+	if err = aU.SetPassword(1, "pwd4"); err != nil {
+		t.Errorf("SetPassword() with a smaller history returns an error: %s", err.Error())
+	}
+
+	aU.SetPasswordHistory(0)
+	if err = aU.SetPassword(1, "pwd3"); err != nil {
+		t.Errorf("SetPassword() without a history returns an error: %s", err.Error())
+	}
+	if u, _ = aU.Get(1); len(u.pwHistory) != 0 {
+		t.Errorf("SetPassword() without a history keeps %d hashes", len(u.pwHistory))
+	}
+}
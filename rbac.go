@@ -0,0 +1,371 @@
+package users
+
+import (
+	"bufio"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Kinds of lines in a policy file.
+const (
+	policyGroup = "group" // roles assigned to a group
+	policyRole  = "role"  // permissions of a role
+	policyUser  = "user"  // roles assigned directly to a user
+)
+
+// Policy holds roles, which bundle named permissions, and their assignments
+// to groups and users. AllUsers.Can() checks permissions against the policy
+// set by AllUsers.SetPolicy(). The zero value is an empty policy.
+//
+// A policy is stored in a file of its own, one line for each role and
+// assignment:
+//
+//	role;<role name>;<permission>,<permission>,...
+//	group;<group id>;<role name>,<role name>,...
+//	user;<user id>;<role name>,<role name>,...
+//
+// A role must be defined before it's assigned. Empty lines and lines starting
+// with "#" are skipped.
+type Policy struct {
+	groupRoles map[int][]string    // roles assigned to groups, the key is the group id
+	roles      map[string][]string // permissions of roles, the key is the role name
+	userRoles  map[int][]string    // roles assigned to users, the key is the user id
+}
+
+// ParsePolicy parses a policy as returned by Policy.String().
+func ParsePolicy(s string) (*Policy, error) {
+	p := &Policy{}
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ";")
+		if l := len(fields); l != 3 {
+			return p, fmt.Errorf("%w, %d fields found instead of 3 in line %d of policy",
+				ErrMissingData, l, n)
+		}
+		kind, key := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		values := []string{}
+		for _, v := range strings.Split(fields[2], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+
+		var err error
+		switch kind {
+		case policyRole:
+			err = p.SetRole(key, values)
+		case policyGroup, policyUser:
+			id, aErr := strconv.Atoi(key)
+			if aErr != nil || id < 0 {
+				return p, fmt.Errorf("%w (%s id) in line %d of policy: %q", ErrInvalidField, kind, n, key)
+			}
+			for _, role := range values {
+				if kind == policyGroup {
+					err = p.AssignRoleToGroup(role, id)
+				} else {
+					err = p.AssignRoleToUser(role, id)
+				}
+				if err != nil {
+					break
+				}
+			}
+		default:
+			err = fmt.Errorf("%w: unknown kind %q", ErrInvalidField, kind)
+		}
+		if err != nil {
+			return p, fmt.Errorf("%w in line %d of policy", err, n)
+		}
+	}
+
+	return p, scanner.Err()
+}
+
+// ReadPolicy reads a policy from the file at path. The key is used to decrypt
+// it like Read() does for user data. If the file doesn't exist, an empty
+// policy will be returned.
+func ReadPolicy(path string, key []byte) (*Policy, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	unlock, err := lockFile(path, false)
+	if err != nil {
+		return &Policy{}, err
+	}
+	defer unlock()
+
+	s, err := readString(path, keyDecoder(key))
+	if err != nil {
+		return &Policy{}, err
+	}
+	return ParsePolicy(s)
+}
+
+// AssignRoleToGroup assigns role to the group with group id groupId, so all
+// its members get the permissions of the role. Roles must be assigned after
+// they have been set by SetRole().
+func (p *Policy) AssignRoleToGroup(role string, groupId int) error {
+	if _, found := p.roles[role]; !found {
+		return fmt.Errorf("%w: %s", ErrNoSuchRole, role)
+	}
+
+	if p.groupRoles == nil {
+		p.groupRoles = make(map[int][]string)
+	}
+	p.groupRoles[groupId] = addName(p.groupRoles[groupId], role)
+	return nil
+}
+
+// AssignRoleToUser assigns role directly to the user with user id userId.
+// Roles must be assigned after they have been set by SetRole().
+func (p *Policy) AssignRoleToUser(role string, userId int) error {
+	if _, found := p.roles[role]; !found {
+		return fmt.Errorf("%w: %s", ErrNoSuchRole, role)
+	}
+
+	if p.userRoles == nil {
+		p.userRoles = make(map[int][]string)
+	}
+	p.userRoles[userId] = addName(p.userRoles[userId], role)
+	return nil
+}
+
+// Permissions returns the permissions of role in alphabetical order.
+func (p Policy) Permissions(role string) []string {
+	return slices.Clone(p.roles[role])
+}
+
+// RemoveRole removes role and its assignments.
+func (p *Policy) RemoveRole(role string) {
+	delete(p.roles, role)
+	for _, assignments := range []map[int][]string{p.groupRoles, p.userRoles} {
+		for id, roles := range assignments {
+			if roles = removeName(roles, role); len(roles) == 0 {
+				delete(assignments, id)
+			} else {
+				assignments[id] = roles
+			}
+		}
+	}
+}
+
+// Roles returns the names of all roles in alphabetical order.
+func (p Policy) Roles() []string {
+	roles := make([]string, 0, len(p.roles))
+	for role := range p.roles {
+		roles = append(roles, role)
+	}
+	slices.Sort(roles)
+	return roles
+}
+
+// SetRole sets the permissions of role, replacing those it had. Names of roles
+// and permissions can't be empty or hold white space, semi colons, colons or
+// comma's.
+func (p *Policy) SetRole(role string, permissions []string) error {
+	if err := validateName(role, ErrInvalidField); err != nil {
+		return fmt.Errorf("%w (role name)", err)
+	}
+
+	perms := []string{}
+	for _, perm := range permissions {
+		if err := validateName(perm, ErrInvalidField); err != nil {
+			return fmt.Errorf("%w (permission) for role %s", err, role)
+		}
+		perms = addName(perms, perm)
+	}
+
+	if p.roles == nil {
+		p.roles = make(map[string][]string)
+	}
+	p.roles[role] = perms
+	return nil
+}
+
+// String writes the policy in a string, formatted as described for Policy.
+func (p Policy) String() string {
+	var b strings.Builder
+	for _, role := range p.Roles() {
+		fmt.Fprintf(&b, "%s;%s;%s\n", policyRole, role, strings.Join(p.roles[role], ","))
+	}
+	for _, id := range sortedIds(p.groupRoles) {
+		fmt.Fprintf(&b, "%s;%d;%s\n", policyGroup, id, strings.Join(p.groupRoles[id], ","))
+	}
+	for _, id := range sortedIds(p.userRoles) {
+		fmt.Fprintf(&b, "%s;%d;%s\n", policyUser, id, strings.Join(p.userRoles[id], ","))
+	}
+	return b.String()
+}
+
+// UnassignRoleFromGroup removes the assignment of role to the group with group
+// id groupId.
+func (p *Policy) UnassignRoleFromGroup(role string, groupId int) {
+	if roles := removeName(p.groupRoles[groupId], role); len(roles) > 0 {
+		p.groupRoles[groupId] = roles
+	} else {
+		delete(p.groupRoles, groupId)
+	}
+}
+
+// UnassignRoleFromUser removes the assignment of role directly to the user
+// with user id userId.
+func (p *Policy) UnassignRoleFromUser(role string, userId int) {
+	if roles := removeName(p.userRoles[userId], role); len(roles) > 0 {
+		p.userRoles[userId] = roles
+	} else {
+		delete(p.userRoles, userId)
+	}
+}
+
+// Write stores the policy in the file at path. The key is used to encrypt it
+// like AllUsers.Write() does for user data.
+func (p Policy) Write(path string, key []byte) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := keyEncoder(key)(p.String())
+	if err != nil {
+		return err
+	}
+	return writeFile(path, []byte(s), 0)
+}
+
+// can returns true if a user with user id userId in the groups with group id's
+// groupIds has permission. A userId of zero only takes the roles of the groups
+// into account.
+func (p Policy) can(userId int, groupIds []int, permission string) bool {
+	roles := slices.Clone(p.userRoles[userId])
+	for _, id := range groupIds {
+		roles = append(roles, p.groupRoles[id]...)
+	}
+
+	for _, role := range roles {
+		if slices.Contains(p.roles[role], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of p that doesn't share any data with p.
+func (p Policy) clone() *Policy {
+	c := &Policy{
+		groupRoles: make(map[int][]string, len(p.groupRoles)),
+		roles:      make(map[string][]string, len(p.roles)),
+		userRoles:  make(map[int][]string, len(p.userRoles)),
+	}
+	for id, roles := range p.groupRoles {
+		c.groupRoles[id] = slices.Clone(roles)
+	}
+	for role, perms := range p.roles {
+		c.roles[role] = slices.Clone(perms)
+	}
+	for id, roles := range p.userRoles {
+		c.userRoles[id] = slices.Clone(roles)
+	}
+	return c
+}
+
+// Can returns true if the user with the provided user name or user id has
+// permission, through a role assigned to one of its groups, including those
+// containing them, or directly to it, according to the policy set by
+// SetPolicy(). Users that are disabled, locked or expired don't have any
+// permissions. Instead of a user name or user id, a *User as returned by
+// AuthenticateAPIKey() can be provided; its groups are used then, so the
+// restrictions of the API key apply. When the key is restricted to some
+// groups, roles assigned directly to the user don't apply.
+func (aU *AllUsers) Can(uNameOrId interface{}, permission string) bool {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	var (
+		groupIds []int
+		scoped   bool
+	)
+	if c, ok := uNameOrId.(*User); ok {
+		uNameOrId = c.userId
+		groupIds = c.groupIds
+		scoped = c.scoped
+	}
+
+	u, found := selectUser(aU, uNameOrId)
+	if !found {
+		return false
+	}
+	if s := u.Status(); s != StatusActive && s != StatusPending {
+		return false
+	}
+	if groupIds == nil {
+		groupIds = u.groupIds
+	} else {
+		// a copy might be outdated
+		groupIds = slices.DeleteFunc(slices.Clone(groupIds), func(id int) bool {
+			return !u.IsInGroup(id)
+		})
+	}
+
+	userId := u.userId
+	if scoped {
+		userId = 0
+	}
+	return aU.policy.can(userId, aU.effectiveGroups(groupIds), permission)
+}
+
+// Policy returns a copy of the policy set by SetPolicy().
+func (aU *AllUsers) Policy() *Policy {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	return aU.policy.clone()
+}
+
+// SetPolicy sets the policy used by Can(). A copy of p is stored, so later
+// changes of p require calling SetPolicy() again.
+func (aU *AllUsers) SetPolicy(p *Policy) {
+	c := p.clone()
+
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	aU.policy = *c
+}
+
+// addName adds name to the sorted names, unless it's present already.
+func addName(names []string, name string) []string {
+	i, found := slices.BinarySearch(names, name)
+	if found {
+		return names
+	}
+	return slices.Insert(names, i, name)
+}
+
+// removeName removes name from the sorted names.
+func removeName(names []string, name string) []string {
+	if i, found := slices.BinarySearch(names, name); found {
+		return slices.Delete(slices.Clone(names), i, i+1)
+	}
+	return names
+}
+
+// sortedIds returns the keys of assignments in ascending order.
+func sortedIds(assignments map[int][]string) []int {
+	ids := make([]int, 0, len(assignments))
+	for id := range assignments {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
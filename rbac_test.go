@@ -0,0 +1,149 @@
+package users
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	p := &Policy{}
+	if err := p.SetRole("accountant", []string{"read-invoices", "delete-invoices", "read-invoices"}); err != nil {
+		t.Fatalf("SetRole() returns an error: %s", err.Error())
+	}
+	if err := p.SetRole("admin", []string{"manage-users"}); err != nil {
+		t.Fatalf("SetRole() returns an error: %s", err.Error())
+	}
+	if err := p.SetRole("a b", nil); !errors.Is(err, ErrInvalidField) {
+		t.Errorf("SetRole() returns error %v, should be %s", err, ErrInvalidField)
+	}
+	if err := p.SetRole("reader", []string{"read,write"}); !errors.Is(err, ErrInvalidField) {
+		t.Errorf("SetRole() returns error %v, should be %s", err, ErrInvalidField)
+	}
+	if err := p.AssignRoleToGroup("accountant", 7); err != nil {
+		t.Errorf("AssignRoleToGroup() returns an error: %s", err.Error())
+	}
+	if err := p.AssignRoleToUser("admin", 2); err != nil {
+		t.Errorf("AssignRoleToUser() returns an error: %s", err.Error())
+	}
+	if err := p.AssignRoleToUser("unknown", 2); !errors.Is(err, ErrNoSuchRole) {
+		t.Errorf("AssignRoleToUser() returns error %v, should be %s", err, ErrNoSuchRole)
+	}
+
+	if got := p.Permissions("accountant"); !slices.Equal(got, []string{"delete-invoices", "read-invoices"}) {
+		t.Errorf("Permissions() returns %v", got)
+	}
+	if got := p.Roles(); !slices.Equal(got, []string{"accountant", "admin"}) {
+		t.Errorf("Roles() returns %v", got)
+	}
+
+	path := filepath.Join("testing", ".policy.txt")
+	defer os.Remove(path)
+	key := []byte("0123456789abcdef")
+	if err := p.Write(path, key); err != nil {
+		t.Fatalf("Write() returns an error: %s", err.Error())
+	}
+	read, err := ReadPolicy(path, key)
+	if err != nil {
+		t.Fatalf("ReadPolicy() returns an error: %s", err.Error())
+	}
+	if got, want := read.String(), p.String(); got != want {
+		t.Errorf("ReadPolicy() returns\n%s\nshould be\n%s", got, want)
+	}
+
+	aU, err := ParseAll("alice@b.c;*;1;7;Alice;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"bob@b.c;*;2;1;Bob;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetPolicy(read)
+
+	tests := []struct {
+		uNameOrId  interface{}
+		permission string
+		can        bool
+	}{
+		{"alice@b.c", "delete-invoices", true},
+		{"alice@b.c", "manage-users", false},
+		{2, "manage-users", true},
+		{2, "read-invoices", false},
+		{3, "read-invoices", false},
+	}
+	for _, tst := range tests {
+		if got := aU.Can(tst.uNameOrId, tst.permission); got != tst.can {
+			t.Errorf("Can(%v, %q) returns %t, should be %t", tst.uNameOrId, tst.permission, got, tst.can)
+		}
+	}
+
+	// the policy of aU is a copy
+	read.RemoveRole("accountant")
+	if !aU.Can(1, "delete-invoices") {
+		t.Errorf("Can() is affected by changing the policy after SetPolicy()")
+	}
+	if got := read.String(); got != "role;admin;manage-users\nuser;2;admin\n" {
+		t.Errorf("String() after RemoveRole() returns %q", got)
+	}
+	p = aU.Policy()
+	p.UnassignRoleFromGroup("accountant", 7)
+	aU.SetPolicy(p)
+	if aU.Can(1, "delete-invoices") {
+		t.Errorf("Can() returns true after UnassignRoleFromGroup()")
+	}
+	p.AssignRoleToGroup("accountant", 7)
+	aU.SetPolicy(p)
+
+	// restrictions of API keys apply
+	aU.SetGroups(1, []int{1, 7})
+	key1, _ := aU.CreateAPIKey(1, "ci", time.Time{}, []int{1})
+	u, err := aU.AuthenticateAPIKey(key1)
+	if err != nil {
+		t.Fatalf("AuthenticateAPIKey() returns an error: %s", err.Error())
+	}
+	if aU.Can(u, "delete-invoices") {
+		t.Errorf("Can() ignores the restrictions of an API key")
+	}
+	if !aU.Can(u.UserId(), "delete-invoices") {
+		t.Errorf("Can() returns false for the user")
+	}
+	p.AssignRoleToUser("admin", 1)
+	aU.SetPolicy(p)
+	if aU.Can(u, "manage-users") {
+		t.Errorf("Can() ignores the restrictions of an API key for a role of the user")
+	}
+	if !aU.Can(1, "manage-users") {
+		t.Errorf("Can() returns false for a role of the user")
+	}
+	key2, _ := aU.CreateAPIKey(1, "all", time.Time{}, nil)
+	if u, _ = aU.AuthenticateAPIKey(key2); !aU.Can(u, "manage-users") {
+		t.Errorf("Can() returns false for a role of the user with an unrestricted API key")
+	}
+
+	aU.Deactivate(1)
+	if aU.Can(1, "delete-invoices") {
+		t.Errorf("Can() returns true for a deactivated user")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		s   string
+		err error
+	}{
+		{"# comment\n\nrole;admin;manage-users\ngroup;1;admin\nuser;2;admin\n", nil},
+		{"role;admin\n", ErrMissingData},
+		{"role;admin;manage users\n", ErrInvalidField},
+		{"group;1;admin\n", ErrNoSuchRole},
+		{"role;admin;manage-users\ngroup;x;admin\n", ErrInvalidField},
+		{"other;admin;manage-users\n", ErrInvalidField},
+	}
+
+	for _, tst := range tests {
+		_, err := ParsePolicy(tst.s)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("ParsePolicy(%q) returns error %q, should be %q", tst.s, sE1, sE2)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+// Recovery codes are formatted in groups of characters separated by dashes.
+const (
+	recoveryCodeLen   = 10 // length of a code in random bytes
+	recoveryGroupSize = 4  // number of characters in a group
+)
+
+// recoveryEncoding encodes recovery codes with characters that are easy to
+// read and type.
+var recoveryEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes generates n new recovery codes for the user with the
+// provided user name or user id. See User.GenerateRecoveryCodes().
+func (aU *AllUsers) GenerateRecoveryCodes(uNameOrId interface{}, n int) ([]string, error) {
+	var codes []string
+	err := aU.update(uNameOrId, func(u *User) (err error) {
+		codes, err = u.GenerateRecoveryCodes(n)
+		return err
+	})
+	return codes, err
+}
+
+// VerifyRecoveryCode verifies a recovery code of the user with the provided
+// user name or user id. It can be used instead of a code for VerifyTOTP(),
+// e.g. when the user lost its authenticator app. A code that matches is
+// consumed, so it can't be used again. A refused code counts as a failed login
+// attempt, see SetLockoutPolicy().
+func (aU *AllUsers) VerifyRecoveryCode(uNameOrId interface{}, code string) error {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	u, found := selectUser(aU, uNameOrId)
+	if !found {
+		return ErrNoSuchUser
+	}
+
+	now := time.Now()
+	if u.status == StatusLocked || aU.lockout.isLocked(u.failures, u.lastFailure, now) {
+		return ErrAccountLocked
+	}
+
+	if !u.useRecoveryCode(code) {
+		u.failures++
+		u.lastFailure = now
+		aU.dirty = true
+		return ErrInvalidCode
+	}
+
+	u.failures = 0
+	u.lastFailure = time.Time{}
+	aU.dirty = true
+	return nil
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of the user by n new ones
+// and returns them. Only their hashes are stored, so the codes can't be
+// retrieved afterwards.
+func (u *User) GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, max(n, 0))
+	hashes := make([]string, len(codes))
+	for i := range codes {
+		b := make([]byte, recoveryCodeLen)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		s := recoveryEncoding.EncodeToString(b)
+		groups := []string{}
+		for len(s) > 0 {
+			l := min(len(s), recoveryGroupSize)
+			groups = append(groups, s[:l])
+			s = s[l:]
+		}
+		codes[i] = strings.Join(groups, "-")
+		hashes[i] = recoveryHash(codes[i])
+	}
+
+	u.recoveryCodes = hashes
+	u.modified = time.Now()
+	return codes, nil
+}
+
+// RecoveryCodesLeft returns the number of recovery codes that haven't been
+// used.
+func (u User) RecoveryCodesLeft() int {
+	return len(u.recoveryCodes)
+}
+
+// recoveryHash returns the hash of a recovery code as it is stored. Dashes,
+// spaces and the case of letters are ignored.
+func recoveryHash(code string) string {
+	return secretHash(strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code)))
+}
+
+// useRecoveryCode removes the hash of code from the recovery codes of u. It
+// returns false when code doesn't match any of them.
+func (u *User) useRecoveryCode(code string) bool {
+	h := []byte(recoveryHash(code))
+
+	found := -1
+	for i, stored := range u.recoveryCodes {
+		// compare with all of them, so the time taken doesn't reveal anything
+		if subtle.ConstantTimeCompare(h, []byte(stored)) == 1 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return false
+	}
+
+	u.recoveryCodes = append(u.recoveryCodes[:found:found], u.recoveryCodes[found+1:]...)
+	u.modified = time.Now()
+	return true
+}
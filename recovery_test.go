@@ -0,0 +1,71 @@
+package users
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	aU, err := ParseAll("a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	codes, err := aU.GenerateRecoveryCodes(1, 5)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes() returns an error: %s", err.Error())
+	}
+	if len(codes) != 5 {
+		t.Fatalf("GenerateRecoveryCodes() returns %d codes, should be 5", len(codes))
+	}
+	re := regexp.MustCompile(`^[a-z2-9]{4}-[a-z2-9]{4}-[a-z2-9]{4}-[a-z2-9]{4}$`)
+	for _, code := range codes {
+		if !re.MatchString(code) {
+			t.Errorf("GenerateRecoveryCodes() returns code %q", code)
+		}
+	}
+
+	// only the hashes are stored
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	if strings.Contains(s, codes[0]) {
+		t.Errorf("String() holds a recovery code")
+	}
+	if aU, err = ParseAll(s); err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	tests := []struct {
+		code string
+		err  error
+		left int
+	}{
+		{codes[1], nil, 4},
+		{codes[1], ErrInvalidCode, 4}, // consumed
+		{" " + strings.ToUpper(strings.ReplaceAll(codes[3], "-", "")), nil, 3},
+		{"abcd-efgh-ijkm-npqr", ErrInvalidCode, 3},
+	}
+
+	for i, tst := range tests {
+		err := aU.VerifyRecoveryCode(1, tst.code)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("%d: VerifyRecoveryCode(%q) returns error %q, should be %q", i, tst.code, sE1, sE2)
+		}
+		if u, _ := aU.Get(1); u.RecoveryCodesLeft() != tst.left {
+			t.Errorf("%d: RecoveryCodesLeft() returns %d, should be %d", i, u.RecoveryCodesLeft(), tst.left)
+		}
+	}
+
+	aU.SetLockoutPolicy(LockoutPolicy{MaxFailures: 1})
+	if err = aU.VerifyRecoveryCode(1, codes[0]); !errors.Is(err, ErrAccountLocked) {
+		t.Errorf("VerifyRecoveryCode() returns error %v, should be %s", err, ErrAccountLocked)
+	}
+
+	if _, err = aU.GenerateRecoveryCodes(2, 5); !errors.Is(err, ErrNoSuchUser) {
+		t.Errorf("GenerateRecoveryCodes() returns error %v, should be %s", err, ErrNoSuchUser)
+	}
+}
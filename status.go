@@ -0,0 +1,87 @@
+package users
+
+import "fmt"
+
+// Status is the status of a user's account.
+type Status int
+
+const (
+	StatusPending  Status = iota // no password has been set yet
+	StatusActive                 // the user can log in
+	StatusDisabled               // disabled by an administrator
+	StatusLocked                 // locked by an administrator
+	StatusExpired                // the account has expired
+)
+
+// statusNames holds the names of the statuses as stored in a file.
+var statusNames = []string{"pending", "active", "disabled", "locked", "expired"}
+
+// impliedStatus returns the status implied by the presence of a password hash.
+// It isn't stored in a file, see statusString().
+func impliedStatus(hashedPassword string) Status {
+	if hashedPassword == "" {
+		return StatusPending
+	}
+	return StatusActive
+}
+
+// parseStatus parses the status field and the password hash field as stored
+// in a file. It returns the status and the password hash. An empty status
+// field is either implied by the hash or, for rows stored before there was a
+// status field, derived from the hash: a hash of "*" means pending, a hash
+// prefixed by "*" means disabled.
+func parseStatus(sStatus, hash string) (Status, string, error) {
+	if sStatus == "" {
+		switch {
+		case hash == "*" || hash == "":
+			return StatusPending, "", nil
+		case hash[:1] == "*":
+			return StatusDisabled, hash[1:], nil
+		}
+		return StatusActive, hash, nil
+	}
+
+	if hash == "*" {
+		hash = ""
+	}
+
+	for i, name := range statusNames {
+		if name == sStatus {
+			return Status(i), hash, nil
+		}
+	}
+	return StatusPending, hash, fmt.Errorf("%w: unknown status %q", ErrInvalidField, sStatus)
+}
+
+// String returns the name of the status.
+func (s Status) String() string {
+	if s < 0 || int(s) >= len(statusNames) {
+		return fmt.Sprintf("Status(%d)", int(s))
+	}
+	return statusNames[s]
+}
+
+// statusString returns the status field for a file. It is empty when the
+// status is implied by the presence of a password hash.
+func statusString(s Status, hashedPassword string) string {
+	if s == impliedStatus(hashedPassword) {
+		return ""
+	}
+	return s.String()
+}
+
+// statusError returns the error telling why the user can't log in because of
+// its status, or nil if it is active.
+func (u User) statusError() error {
+	switch u.Status() {
+	case StatusActive:
+		return nil
+	case StatusPending:
+		return ErrNoPassword
+	case StatusLocked:
+		return ErrAccountLocked
+	case StatusExpired:
+		return ErrAccountExpired
+	}
+	return ErrUserDeactivated
+}
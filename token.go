@@ -0,0 +1,283 @@
+package users
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenPurpose is the action a token issued by IssueToken() or
+// IssueChangeEMailToken() can be redeemed for.
+type TokenPurpose int
+
+const (
+	PurposeResetPassword TokenPurpose = iota + 1 // set a new password
+	PurposeVerifyEMail                           // mark the user name as verified
+	PurposeChangeEMail                           // change the user name to a verified address
+)
+
+// purposeNames holds the names of the purposes as stored in a file.
+var purposeNames = []string{"", "reset-password", "verify-email", "change-email"}
+
+// tokenLen is the length of a token in random bytes.
+const tokenLen = 32
+
+// token holds the data of an issued token. Tokens are stored by their hash.
+type token struct {
+	data    string       // user name to verify or new user name to change to
+	expires time.Time    // time the token expires
+	purpose TokenPurpose // action the token can be redeemed for
+	userId  int          // user the token has been issued for
+}
+
+// String returns the name of the purpose.
+func (p TokenPurpose) String() string {
+	if p <= 0 || int(p) >= len(purposeNames) {
+		return fmt.Sprintf("TokenPurpose(%d)", int(p))
+	}
+	return purposeNames[p]
+}
+
+// IssueChangeEMailToken issues a token for changing the user name of the user
+// with the provided user name or user id into newUserName, which must be a
+// valid e-mail address that isn't in use. The token should be sent to that
+// address, so redeeming it proves it belongs to the user. See IssueToken().
+func (aU *AllUsers) IssueChangeEMailToken(uNameOrId interface{}, newUserName string, ttl time.Duration) (string, error) {
+	newUserName = strings.TrimSpace(newUserName)
+	if !isValidEMailAddress(newUserName) {
+		return "", ErrInvalidUserName
+	}
+	return aU.issueToken(uNameOrId, PurposeChangeEMail, newUserName, ttl)
+}
+
+// IssueToken issues a token for the user with the provided user name or user
+// id that can be redeemed once by Redeem() for purpose, until ttl has passed.
+// Only a hash of the token is stored. Tokens issued before for the same user
+// and purpose become invalid. PurposeChangeEMail requires
+// IssueChangeEMailToken().
+func (aU *AllUsers) IssueToken(uNameOrId interface{}, purpose TokenPurpose, ttl time.Duration) (string, error) {
+	if purpose != PurposeResetPassword && purpose != PurposeVerifyEMail {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPurpose, purpose)
+	}
+	return aU.issueToken(uNameOrId, purpose, "", ttl)
+}
+
+// Redeem validates a token issued for purpose and performs its action at
+// once. A token can only be redeemed once:
+//   - PurposeResetPassword sets plainPassword as the new password, like
+//     SetPassword() does, and clears the failed login attempts;
+//   - PurposeVerifyEMail marks the user name as verified, see EMailVerified();
+//   - PurposeChangeEMail changes the user name into the address the token has
+//     been issued for and marks it as verified.
+//
+// It returns a copy of the modified user. Unknown and expired tokens, and
+// tokens issued for another purpose, are refused with ErrInvalidToken. Users
+// that are disabled, locked or expired can't redeem tokens; their tokens stay
+// valid then. A PurposeVerifyEMail token is refused with ErrInvalidToken too
+// once the user name has changed after it has been issued.
+func (aU *AllUsers) Redeem(tkn string, purpose TokenPurpose, plainPassword string) (*User, error) {
+	h := secretHash(strings.TrimSpace(tkn))
+	now := time.Now()
+
+	// valid returns the user the token has been issued for, while holding
+	// the lock
+	valid := func(t token, found bool) (*User, error) {
+		if !found || t.purpose != purpose || !now.Before(t.expires) {
+			return &User{}, ErrInvalidToken
+		}
+		u, found := aU.usersById[t.userId]
+		if !found || (t.purpose == PurposeVerifyEMail && t.data != u.userName) {
+			return &User{}, ErrInvalidToken
+		}
+		if s := u.Status(); s != StatusActive && s != StatusPending {
+			return &User{}, u.statusError()
+		}
+		return u, nil
+	}
+
+	aU.mu.RLock()
+	t, found := aU.tokens[h]
+	u, err := valid(t, found)
+	user := *u.clone()
+	aU.mu.RUnlock()
+
+	if err != nil {
+		return &User{}, err
+	}
+
+	var (
+		newHash string
+		n       int
+	)
+	if purpose == PurposeResetPassword {
+		if newHash, n, err = aU.hashNewPassword(user, plainPassword); err != nil {
+			return &User{}, err
+		}
+	}
+
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	// the token might have been redeemed in the meantime
+	t2, found := aU.tokens[h]
+	if u, err = valid(t2, found && t2 == t); err != nil {
+		return &User{}, err
+	}
+
+	switch purpose {
+	case PurposeResetPassword:
+		u.keepPassword(n)
+		u.setHashedPassword(newHash)
+		u.failures = 0
+		u.lastFailure = time.Time{}
+	case PurposeVerifyEMail:
+		u.verified = true
+		u.modified = now
+	case PurposeChangeEMail:
+		if err = u.SetUserName(t.data); err != nil {
+			return &User{}, err
+		}
+		u.verified = true
+	}
+
+	delete(aU.tokens, h)
+	aU.dirty = true
+	return u.clone(), nil
+}
+
+// dropTokens removes the tokens issued for the user with user id id, or only
+// those for purpose if it isn't zero. Expired tokens are removed as well.
+func (aU *AllUsers) dropTokens(id int, purpose TokenPurpose) {
+	now := time.Now()
+	for h, t := range aU.tokens {
+		if (t.userId == id && (purpose == 0 || t.purpose == purpose)) || !now.Before(t.expires) {
+			delete(aU.tokens, h)
+		}
+	}
+}
+
+// issueToken issues a token for purpose holding data. See IssueToken().
+func (aU *AllUsers) issueToken(uNameOrId interface{}, purpose TokenPurpose, data string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", fmt.Errorf("%w: time to live %s isn't positive", ErrInvalidTime, ttl)
+	}
+
+	b := make([]byte, tokenLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	tkn := base64.RawURLEncoding.EncodeToString(b)
+
+	err := aU.update(uNameOrId, func(u *User) error {
+		if purpose == PurposeChangeEMail {
+			if _, found := selectUser(aU, data); found {
+				return ErrUserExists
+			}
+		}
+		if purpose == PurposeVerifyEMail {
+			data = u.userName
+		}
+
+		aU.dropTokens(u.userId, purpose)
+		if aU.tokens == nil {
+			aU.tokens = make(map[string]token)
+		}
+		aU.tokens[secretHash(tkn)] = token{
+			data:    data,
+			expires: time.Now().Add(ttl),
+			purpose: purpose,
+			userId:  u.userId,
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return tkn, nil
+}
+
+// parsePurpose parses the name of a purpose.
+func parsePurpose(s string) (TokenPurpose, error) {
+	for i, name := range purposeNames {
+		if i > 0 && name == s {
+			return TokenPurpose(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrInvalidPurpose, s)
+}
+
+// parseToken parses a token line formatted as "t;<hash>;<user id>;<purpose>;
+// <expiry time>;<data>" and stores it in aU. The data field is optional.
+func (aU *AllUsers) parseToken(s string) error {
+	fields := strings.Split(strings.TrimPrefix(s, tokenMark), ";")
+	if l := len(fields); l < 4 {
+		return fmt.Errorf("%w, less than 5 fields found for token: %d",
+			ErrMissingData, l+1)
+	}
+
+	h := strings.TrimSpace(fields[0])
+	if _, err := hex.DecodeString(h); err != nil || len(h) != 2*sha256.Size {
+		return fmt.Errorf("%w (token hash): %q", ErrInvalidField, h)
+	}
+
+	var (
+		t   token
+		err error
+	)
+	t.userId, err = strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil || t.userId <= 0 {
+		return fmt.Errorf("%w for token: %s", ErrInvalidUserId, fields[1])
+	}
+
+	if t.purpose, err = parsePurpose(strings.TrimSpace(fields[2])); err != nil {
+		return fmt.Errorf("%w for token of user %d", err, t.userId)
+	}
+
+	t.expires, err = time.Parse(time.RFC3339, strings.TrimSpace(fields[3]))
+	if err != nil {
+		return fmt.Errorf("%w (expiry) for token of user %d: %w", ErrInvalidTime, t.userId, err)
+	}
+
+	if len(fields) > 4 {
+		t.data = strings.TrimSpace(fields[4])
+	}
+
+	if aU.tokens == nil {
+		aU.tokens = make(map[string]token)
+	}
+	aU.tokens[h] = t
+	return nil
+}
+
+// tokenStrings returns the token lines for the tokens that haven't expired,
+// ordered by user id and hash.
+func (aU *AllUsers) tokenStrings() []string {
+	hashes := make([]string, 0, len(aU.tokens))
+	now := time.Now()
+	for h, t := range aU.tokens {
+		if now.Before(t.expires) {
+			hashes = append(hashes, h)
+		}
+	}
+	slices.SortFunc(hashes, func(a, b string) int {
+		if c := cmp.Compare(aU.tokens[a].userId, aU.tokens[b].userId); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+
+	lines := make([]string, len(hashes))
+	for i, h := range hashes {
+		t := aU.tokens[h]
+		lines[i] = fmt.Sprintf("%s%s;%d;%s;%s", tokenMark, h, t.userId, t.purpose,
+			t.expires.Format(time.RFC3339)) + optionalFields(t.data)
+	}
+	return lines
+}
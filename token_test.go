@@ -0,0 +1,167 @@
+package users
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTokens(t *testing.T) {
+	aU, err := ParseAll("a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n" +
+		"d@e.f;*;2;1;D;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+
+	reset, err := aU.IssueToken(1, PurposeResetPassword, time.Hour)
+	if err != nil {
+		t.Fatalf("IssueToken() returns an error: %s", err.Error())
+	}
+	verify, err := aU.IssueToken("a@b.c", PurposeVerifyEMail, time.Hour)
+	if err != nil {
+		t.Fatalf("IssueToken() returns an error: %s", err.Error())
+	}
+	change, err := aU.IssueChangeEMailToken(1, "x@y.z", time.Hour)
+	if err != nil {
+		t.Fatalf("IssueChangeEMailToken() returns an error: %s", err.Error())
+	}
+	expired, err := aU.IssueToken(2, PurposeResetPassword, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("IssueToken() returns an error: %s", err.Error())
+	}
+
+	issueTests := []struct {
+		uNameOrId interface{}
+		purpose   TokenPurpose
+		ttl       time.Duration
+		err       error
+	}{
+		{1, PurposeChangeEMail, time.Hour, ErrInvalidPurpose},
+		{1, TokenPurpose(9), time.Hour, ErrInvalidPurpose},
+		{1, PurposeVerifyEMail, 0, ErrInvalidTime},
+		{3, PurposeVerifyEMail, time.Hour, ErrNoSuchUser},
+	}
+	for _, tst := range issueTests {
+		_, err := aU.IssueToken(tst.uNameOrId, tst.purpose, tst.ttl)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("IssueToken(%v, %s) returns error %q, should be %q", tst.uNameOrId, tst.purpose, sE1, sE2)
+		}
+	}
+	if _, err = aU.IssueChangeEMailToken(1, "d@e.f", time.Hour); !errors.Is(err, ErrUserExists) {
+		t.Errorf("IssueChangeEMailToken() returns error %v, should be %s", err, ErrUserExists)
+	}
+	if _, err = aU.IssueChangeEMailToken(1, "no address", time.Hour); !errors.Is(err, ErrInvalidUserName) {
+		t.Errorf("IssueChangeEMailToken() returns error %v, should be %s", err, ErrInvalidUserName)
+	}
+
+	// only the hashes are stored and expired tokens are dropped
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	if strings.Contains(s, reset) {
+		t.Errorf("String() holds a token")
+	}
+	if n := strings.Count(s, tokenMark); n != 3 {
+		t.Errorf("String() holds %d tokens, should be 3", n)
+	}
+	if aU, err = ParseAll(s); err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+
+	tests := []struct {
+		token    string
+		purpose  TokenPurpose
+		password string
+		err      error
+	}{
+		{reset, PurposeVerifyEMail, "", ErrInvalidToken},
+		{reset, PurposeResetPassword, "", ErrPasswordEmpty},
+		{reset, PurposeResetPassword, "a@pNn00tm13s", nil},
+		{reset, PurposeResetPassword, "a@pNn00tm13s", ErrInvalidToken}, // used
+		{expired, PurposeResetPassword, "a@pNn00tm13s", ErrInvalidToken},
+		{"unknown", PurposeResetPassword, "a@pNn00tm13s", ErrInvalidToken},
+		{verify, PurposeVerifyEMail, "", nil},
+	}
+	for i, tst := range tests {
+		_, err := aU.Redeem(tst.token, tst.purpose, tst.password)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("%d: Redeem(%s) returns error %q, should be %q", i, tst.purpose, sE1, sE2)
+		}
+	}
+
+	u, _ := aU.Get(1)
+	if err = u.ValidatePassword("a@pNn00tm13s"); err != nil {
+		t.Errorf("ValidatePassword() after a reset returns an error: %s", err.Error())
+	}
+	if !u.EMailVerified() {
+		t.Errorf("EMailVerified() returns false after verification")
+	}
+
+	aU.Deactivate(1)
+	if _, err = aU.Redeem(change, PurposeChangeEMail, ""); !errors.Is(err, ErrUserDeactivated) {
+		t.Errorf("Redeem() for a deactivated user returns error %v, should be %s", err, ErrUserDeactivated)
+	}
+	aU.Reactivate(1)
+
+	aU.SetUserName(1, "p@q.r")
+	if u, _ = aU.Get(1); u.EMailVerified() {
+		t.Errorf("EMailVerified() returns true after changing the user name")
+	}
+
+	u, err = aU.Redeem(change, PurposeChangeEMail, "")
+	if err != nil {
+		t.Fatalf("Redeem() returns an error: %s", err.Error())
+	}
+	if u.UserName() != "x@y.z" || !u.EMailVerified() {
+		t.Errorf("Redeem() changes user name into %q, verified %t", u.UserName(), u.EMailVerified())
+	}
+	if _, err = aU.Get("x@y.z"); err != nil {
+		t.Errorf("Get() for the new user name returns an error: %s", err.Error())
+	}
+
+	// a verification token is bound to the user name it has been issued for
+	verify, _ = aU.IssueToken(2, PurposeVerifyEMail, time.Hour)
+	aU.SetUserName(2, "s@e.f")
+	if _, err = aU.Redeem(verify, PurposeVerifyEMail, ""); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Redeem() after changing the user name returns error %v, should be %s", err, ErrInvalidToken)
+	}
+	if u, _ = aU.Get(2); u.EMailVerified() {
+		t.Errorf("EMailVerified() returns true for an unverified user name")
+	}
+
+	// tokens of removed users are dropped
+	reset, _ = aU.IssueToken(1, PurposeResetPassword, time.Hour)
+	aU.Remove(1)
+	if _, err = aU.Redeem(reset, PurposeResetPassword, "a@pNn00tm13s"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Redeem() for a removed user returns error %v, should be %s", err, ErrInvalidToken)
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	h := secretHash("token")
+	tests := []struct {
+		s   string
+		err error
+	}{
+		{"t;" + h + ";1;reset-password;2023-11-24T15:38:00Z", nil},
+		{"t;" + h + ";1;change-email;2023-11-24T15:38:00Z;a@b.c", nil},
+		{"t;" + h + ";1;reset-password", ErrMissingData},
+		{"t;abc;1;reset-password;2023-11-24T15:38:00Z", ErrInvalidField},
+		{"t;" + h + ";x;reset-password;2023-11-24T15:38:00Z", ErrInvalidUserId},
+		{"t;" + h + ";1;unknown;2023-11-24T15:38:00Z", ErrInvalidPurpose},
+		{"t;" + h + ";1;reset-password;yesterday", ErrInvalidTime},
+	}
+
+	for _, tst := range tests {
+		_, err := ParseAll(tst.s + "\n")
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("ParseAll(%q) returns error %q, should be %q", tst.s, sE1, sE2)
+		}
+	}
+}
@@ -2,11 +2,109 @@ package users
 
 import (
 	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"net/mail"
 	"slices"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
+// flagMustChangePassword is stored in the flags field of a user that must
+// change its password on the next login.
+const flagMustChangePassword = "must-change-password"
+
+// flagVerified is stored in the flags field of a user whose user name has been
+// verified to be its e-mail address.
+const flagVerified = "verified"
+
+// Marks starting the lines that follow the users. As none of them is a valid
+// e-mail address, such a line can't be mistaken for a user.
+const (
+	apiKeyMark    = "k;" // API key
+	groupMark     = "g;" // group
+	tokenMark     = "t;" // token
+	tombstoneMark = "-;" // tombstone of a removed user
+)
+
+// compareUserId compares the user id of u with id, for searching in slices
+// of users sorted by user id.
+func compareUserId(u *User, id int) int {
+	return cmp.Compare(u.userId, id)
+}
+
+// countString returns n as a string, or an empty string when n is zero.
+func countString(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// flagsString returns the flags field of u: the names of the flags that are
+// set, separated by comma's.
+func (u User) flagsString() string {
+	flags := []string{}
+	if u.mustChange {
+		flags = append(flags, flagMustChangePassword)
+	}
+	if u.verified {
+		flags = append(flags, flagVerified)
+	}
+	return strings.Join(flags, ",")
+}
+
+// hasherOrDefault returns the Hasher for new passwords.
+func (aU *AllUsers) hasherOrDefault() Hasher {
+	if aU.hasher == nil {
+		return defaultHasher
+	}
+	return aU.hasher
+}
+
+// hashNewPassword checks whether plainPassword may become the new password of
+// u, see SetPassword(), and returns its hash together with the number of
+// previous passwords to keep. As hashing is slow, it must be called without
+// holding the lock of aU.
+func (aU *AllUsers) hashNewPassword(u User, plainPassword string) (string, int, error) {
+	aU.mu.RLock()
+	hasher := aU.hasherOrDefault()
+	n := aU.pwHistory
+	policy := aU.pwPolicy
+	aU.mu.RUnlock()
+
+	if err := policy.Check(u, plainPassword); err != nil {
+		return "", n, err
+	}
+	if n > 0 && u.isReused(plainPassword, n) {
+		return "", n, ErrPasswordReused
+	}
+
+	h, err := hasher.Hash(plainPassword)
+	return h, n, err
+}
+
+// indexGroups adds u to the members of its groups in the index of aU. A user
+// with the same user id is replaced.
+func (aU *AllUsers) indexGroups(u *User) {
+	if aU.usersByGroup == nil {
+		aU.usersByGroup = make(map[int][]*User)
+	}
+
+	for _, g := range u.groupIds {
+		members := aU.usersByGroup[g]
+		i, found := slices.BinarySearchFunc(members, u.userId, compareUserId)
+		if found {
+			members[i] = u
+		} else {
+			aU.usersByGroup[g] = slices.Insert(members, i, u)
+		}
+	}
+}
+
 func intsString(ints []int) (s string) {
 	sep := ""
 	for _, i := range ints {
@@ -36,10 +134,81 @@ func (aU *AllUsers) mapUser(u *User) {
 
 	aU.usersByEMail[u.userName] = u
 	aU.usersById[u.userId] = u
+	aU.indexGroups(u)
 	u.allUsers = aU
 
 }
 
+// optionalFields returns the fields, each preceded by a semi colon. Trailing
+// empty fields are left out.
+func optionalFields(fields ...string) string {
+	for len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return ";" + strings.Join(fields, ";")
+}
+
+// optionalTimeString returns t in RFC3339 format, or an empty string when t
+// is the zero time.
+func optionalTimeString(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// parseCount parses a non negative number as returned by countString().
+func parseCount(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("negative number %d", n)
+	}
+	return n, err
+}
+
+// parseFlags parses a flags field as returned by flagsString() and sets the
+// flags of u.
+func (u *User) parseFlags(s string) error {
+	if s == "" {
+		return nil
+	}
+
+	for _, flag := range strings.Split(s, ",") {
+		switch strings.TrimSpace(flag) {
+		case flagMustChangePassword:
+			u.mustChange = true
+		case flagVerified:
+			u.verified = true
+		default:
+			return fmt.Errorf("%w: unknown flag %q", ErrInvalidField, flag)
+		}
+	}
+	return nil
+}
+
+// parseOptionalTime parses a time as returned by optionalTimeString().
+func parseOptionalTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// secretHash returns the hex encoded SHA-256 hash of a random secret, as API
+// keys, tokens and recovery codes are stored. As they are random, a plain
+// hash suffices.
+func secretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
 func selectUser(aU *AllUsers, sOrI interface{}) (*User, bool) {
 	var (
 		u     *User
@@ -78,4 +247,133 @@ func (aU *AllUsers) unMapUser(u *User) {
 		delete(aU.usersByEMail, u.userName)
 		delete(aU.usersById, u.userId)
 	}
+	aU.unIndexGroups(u)
+}
+
+// unIndexGroups removes u from the members of its groups in the index of aU.
+func (aU *AllUsers) unIndexGroups(u *User) {
+	for _, g := range u.groupIds {
+		members := aU.usersByGroup[g]
+		if i, found := slices.BinarySearchFunc(members, u.userId, compareUserId); found {
+			members = slices.Delete(members, i, i+1)
+		}
+		if len(members) == 0 {
+			delete(aU.usersByGroup, g)
+		} else {
+			aU.usersByGroup[g] = members
+		}
+	}
+}
+
+// parseTombstone parses a tombstone line formatted as "-;<user id>;<time of
+// removal>" and stores it in aU.
+func (aU *AllUsers) parseTombstone(s string) error {
+	fields := strings.Split(strings.TrimPrefix(s, tombstoneMark), ";")
+	if l := len(fields); l < 2 {
+		return fmt.Errorf("%w, less than 3 fields found for tombstone: %d",
+			ErrMissingData, l+1)
+	}
+
+	id, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil || id <= 0 {
+		return fmt.Errorf("%w for tombstone: %s", ErrInvalidUserId, fields[0])
+	}
+
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(fields[1]))
+	if err != nil {
+		return fmt.Errorf("%w (removal) for tombstone %d: %w", ErrInvalidTime, id, err)
+	}
+
+	if aU.removed == nil {
+		aU.removed = make(map[int]time.Time)
+	}
+	aU.removed[id] = t
+	if id > aU.lastId {
+		aU.lastId = id
+	}
+	return nil
+}
+
+// string writes the user data in a string like String() does, without
+// locking aU.
+func (aU *AllUsers) string() (string, error) {
+	sortedUsers := aU.sort()
+
+	var b strings.Builder
+	for _, usr := range sortedUsers {
+		if _, err := b.WriteString(usr.String() + "\n"); err != nil {
+			return "", err
+		}
+	}
+
+	for _, line := range aU.groupStrings() {
+		if _, err := b.WriteString(line + "\n"); err != nil {
+			return "", err
+		}
+	}
+
+	for _, line := range aU.apiKeyStrings() {
+		if _, err := b.WriteString(line + "\n"); err != nil {
+			return "", err
+		}
+	}
+
+	for _, line := range aU.tokenStrings() {
+		if _, err := b.WriteString(line + "\n"); err != nil {
+			return "", err
+		}
+	}
+
+	if !aU.dropTombstones {
+		for _, id := range aU.tombstones() {
+			if _, err := b.WriteString(aU.tombstoneString(id) + "\n"); err != nil {
+				return "", err
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// tombstones returns the user id's of the removed users in ascending order.
+func (aU *AllUsers) tombstones() []int {
+	ids := make([]int, 0, len(aU.removed))
+	for id := range aU.removed {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// tombstoneString returns the tombstone line for the removed user with
+// user id id.
+func (aU *AllUsers) tombstoneString(id int) string {
+	return fmt.Sprintf("%s%d;%s", tombstoneMark, id, aU.removed[id].Format(time.RFC3339))
+}
+
+// validateName returns errInvalid if name can't be used as the name of a
+// group, a role or a permission: it can't be empty or hold white space, semi
+// colons, colons or comma's.
+func validateName(name string, errInvalid error) error {
+	if name == "" || strings.ContainsAny(name, ";:,") || strings.ContainsFunc(name, unicode.IsSpace) {
+		return fmt.Errorf("%w: %q", errInvalid, name)
+	}
+	return nil
+}
+
+// update calls f for the user with the provided user name or user id while
+// holding the lock of aU.
+func (aU *AllUsers) update(uNameOrId interface{}, f func(u *User) error) error {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	u, found := selectUser(aU, uNameOrId)
+	if !found {
+		return ErrNoSuchUser
+	}
+
+	if err := f(u); err != nil {
+		return err
+	}
+	aU.dirty = true
+	return nil
 }
@@ -0,0 +1,220 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TOTP parameters as used by most authenticator apps (RFC 6238).
+const (
+	totpDigits    = 6  // number of digits of a code
+	totpPeriod    = 30 // seconds a code is valid
+	totpSecretLen = 20 // length of a secret in bytes
+	totpSkew      = 1  // number of periods a code may be early or late
+)
+
+// totpEncoding encodes TOTP secrets as expected by authenticator apps.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ConfirmTOTP completes the enrolment started by EnrolTOTP() for the user with
+// the provided user name or user id, by verifying the first code generated by
+// the authenticator app. Until then the second factor isn't required. It
+// returns ErrInvalidCode when the code doesn't match.
+func (aU *AllUsers) ConfirmTOTP(uNameOrId interface{}, code string) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		if u.totpSecret == "" {
+			return ErrTOTPNotEnrolled
+		}
+		if u.totpStep > 0 {
+			return ErrTOTPEnrolled
+		}
+
+		step, err := aU.matchTOTP(u, code, time.Now())
+		if err != nil {
+			return err
+		}
+
+		u.totpStep = step
+		u.modified = time.Now()
+		return nil
+	})
+}
+
+// DisableTOTP removes the TOTP secret of the user with the provided user name
+// or user id, so a second factor isn't required anymore.
+func (aU *AllUsers) DisableTOTP(uNameOrId interface{}) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		if u.totpSecret == "" {
+			return ErrTOTPNotEnrolled
+		}
+
+		u.totpSecret = ""
+		u.totpStep = 0
+		u.modified = time.Now()
+		return nil
+	})
+}
+
+// EnrolTOTP generates a new TOTP secret for the user with the provided user
+// name or user id and returns an otpauth:// URI holding it, to be shown to the
+// user, e.g. as a QR code, for adding it to an authenticator app. The secret
+// is stored encrypted with the key set by SetSecretKey(). The enrolment must
+// be completed by ConfirmTOTP(). A user for which it has been completed
+// already, gets ErrTOTPEnrolled.
+func (aU *AllUsers) EnrolTOTP(uNameOrId interface{}, issuer string) (string, error) {
+	secret := make([]byte, totpSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	sSecret := totpEncoding.EncodeToString(secret)
+
+	var uri string
+	err := aU.update(uNameOrId, func(u *User) error {
+		if u.totpStep > 0 {
+			return ErrTOTPEnrolled
+		}
+		if len(aU.secretKey) == 0 {
+			return ErrNoSecretKey
+		}
+
+		encrypted, err := en(sSecret, aU.secretKey)
+		if err != nil {
+			return err
+		}
+
+		u.totpSecret = encrypted
+		u.modified = time.Now()
+		uri = totpURI(issuer, u.userName, sSecret)
+		return nil
+	})
+	return uri, err
+}
+
+// SetSecretKey sets the key for encrypting secrets of users, like their TOTP
+// secrets. The key must have a length of 16, 24, or 32 bytes.
+func (aU *AllUsers) SetSecretKey(key []byte) error {
+	if err := testKey(key); err != nil {
+		return err
+	}
+
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	aU.secretKey = append([]byte{}, key...)
+	return nil
+}
+
+// VerifyTOTP verifies a code generated by the authenticator app of the user
+// with the provided user name or user id, after its password has been
+// validated by Authenticate(). A code is accepted when it's up to one period
+// early or late, but only once: a code that has been accepted before or that
+// is older than that one, is refused. A refused code counts as a failed login
+// attempt, see SetLockoutPolicy().
+func (aU *AllUsers) VerifyTOTP(uNameOrId interface{}, code string) error {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	u, found := selectUser(aU, uNameOrId)
+	if !found {
+		return ErrNoSuchUser
+	}
+	if u.totpStep == 0 {
+		return ErrTOTPNotEnrolled
+	}
+
+	now := time.Now()
+	if u.status == StatusLocked || aU.lockout.isLocked(u.failures, u.lastFailure, now) {
+		return ErrAccountLocked
+	}
+
+	step, err := aU.matchTOTP(u, code, now)
+	if err == nil && step <= u.totpStep {
+		err = fmt.Errorf("%w: code has been used before", ErrInvalidCode)
+	}
+	if err != nil {
+		u.failures++
+		u.lastFailure = now
+		aU.dirty = true
+		return err
+	}
+
+	u.totpStep = step
+	u.failures = 0
+	u.lastFailure = time.Time{}
+	aU.dirty = true
+	return nil
+}
+
+// TOTPEnabled returns true if a second factor is required, i.e. the user has
+// completed the enrolment for TOTP.
+func (u User) TOTPEnabled() bool {
+	return u.totpSecret != "" && u.totpStep > 0
+}
+
+// matchTOTP decrypts the secret of u and returns the step at which code is
+// valid around now. It returns ErrInvalidCode when it isn't valid.
+func (aU *AllUsers) matchTOTP(u *User, code string, now time.Time) (int64, error) {
+	if len(aU.secretKey) == 0 {
+		return 0, ErrNoSecretKey
+	}
+
+	sSecret, err := de(u.totpSecret, aU.secretKey)
+	if err != nil {
+		return 0, err
+	}
+	secret, err := totpEncoding.DecodeString(sSecret)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrDecryption, err)
+	}
+
+	code = strings.TrimSpace(code)
+	current := now.Unix() / totpPeriod
+	for step := current + totpSkew; step >= current-totpSkew; step-- {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrInvalidCode
+}
+
+// totpCode returns the code for secret at step as defined by RFC 4226 and
+// RFC 6238.
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, n%mod)
+}
+
+// totpURI returns an otpauth:// URI for an authenticator app.
+func totpURI(issuer, userName, secret string) string {
+	label := url.PathEscape(userName)
+	q := url.Values{}
+	q.Set("secret", secret)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+		q.Set("issuer", issuer)
+	}
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(totpPeriod))
+
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
@@ -0,0 +1,140 @@
+package users
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors of RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tst := range tests {
+		if got := totpCode(secret, tst.unix/totpPeriod); got != tst.code {
+			t.Errorf("totpCode() at %d returns %q, should be %q", tst.unix, got, tst.code)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	pwd := "a@pNn00tm13s"
+	hash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash(pwd)
+	if err != nil {
+		t.Fatalf("Hash() returns an error: %s", err.Error())
+	}
+
+	aU, err := ParseAll("a@b.c;" + hash + ";1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z\n")
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetHasher(BcryptHasher{Cost: bcrypt.MinCost})
+
+	if _, err = aU.EnrolTOTP(1, "Example"); !errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("EnrolTOTP() returns error %v, should be %s", err, ErrNoSecretKey)
+	}
+	if err = aU.SetSecretKey([]byte("short")); err == nil {
+		t.Errorf("SetSecretKey() with an invalid key doesn't return an error")
+	}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err = aU.SetSecretKey(key); err != nil {
+		t.Fatalf("SetSecretKey() returns an error: %s", err.Error())
+	}
+
+	uri, err := aU.EnrolTOTP(1, "Example")
+	if err != nil {
+		t.Fatalf("EnrolTOTP() returns an error: %s", err.Error())
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("EnrolTOTP() returns an invalid URI %q: %s", uri, err.Error())
+	}
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" || parsed.Path != "/Example:a@b.c" ||
+		parsed.Query().Get("issuer") != "Example" {
+		t.Errorf("EnrolTOTP() returns URI %q", uri)
+	}
+	secret, err := totpEncoding.DecodeString(parsed.Query().Get("secret"))
+	if err != nil {
+		t.Fatalf("EnrolTOTP() returns URI with an invalid secret: %s", err.Error())
+	}
+
+	step := time.Now().Unix() / totpPeriod
+
+	// not required before the enrolment is confirmed
+	if _, err = aU.Authenticate("a@b.c", pwd); err != nil {
+		t.Errorf("Authenticate() before ConfirmTOTP() returns an error: %s", err.Error())
+	}
+	if err = aU.VerifyTOTP(1, totpCode(secret, step)); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Errorf("VerifyTOTP() before ConfirmTOTP() returns error %v, should be %s", err, ErrTOTPNotEnrolled)
+	}
+
+	if err = aU.ConfirmTOTP(1, totpCode(secret, step+5)); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("ConfirmTOTP() with a wrong code returns error %v, should be %s", err, ErrInvalidCode)
+	}
+	if err = aU.ConfirmTOTP(1, totpCode(secret, step)); err != nil {
+		t.Fatalf("ConfirmTOTP() returns an error: %s", err.Error())
+	}
+	if _, err = aU.EnrolTOTP(1, "Example"); !errors.Is(err, ErrTOTPEnrolled) {
+		t.Errorf("EnrolTOTP() after ConfirmTOTP() returns error %v, should be %s", err, ErrTOTPEnrolled)
+	}
+
+	u, err := aU.Authenticate("a@b.c", pwd)
+	if !errors.Is(err, ErrSecondFactorRequired) {
+		t.Errorf("Authenticate() returns error %v, should be %s", err, ErrSecondFactorRequired)
+	} else if !u.TOTPEnabled() {
+		t.Errorf("TOTPEnabled() returns false after ConfirmTOTP()")
+	}
+
+	// the user data survive writing and parsing
+	s, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+	if aU, err = ParseAll(s); err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+	aU.SetSecretKey(key)
+
+	tests := []struct {
+		code string
+		err  error
+	}{
+		{totpCode(secret, step), ErrInvalidCode}, // used by ConfirmTOTP()
+		{totpCode(secret, step+1), nil},
+		{totpCode(secret, step+1), ErrInvalidCode}, // replayed
+		{totpCode(secret, step), ErrInvalidCode},   // older than the last one
+		{totpCode(secret, step+3), ErrInvalidCode}, // outside the window
+	}
+
+	for i, tst := range tests {
+		err := aU.VerifyTOTP("a@b.c", tst.code)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil && sE1 != "" {
+			t.Errorf("%d: VerifyTOTP() returns error %q, should be %q", i, sE1, sE2)
+		}
+	}
+	if u, _ = aU.Get(1); u.FailedLogins() != 3 {
+		t.Errorf("refused codes count as %d failed logins, should be 3", u.FailedLogins())
+	}
+
+	if err = aU.DisableTOTP(1); err != nil {
+		t.Fatalf("DisableTOTP() returns an error: %s", err.Error())
+	}
+	if _, err = aU.Authenticate("a@b.c", pwd); err != nil {
+		t.Errorf("Authenticate() after DisableTOTP() returns an error: %s", err.Error())
+	}
+	if err = aU.DisableTOTP(1); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Errorf("DisableTOTP() returns error %v, should be %s", err, ErrTOTPNotEnrolled)
+	}
+}
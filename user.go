@@ -2,34 +2,61 @@ package users
 
 import (
 	"fmt"
+	"maps"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 // User holds the data for a user
 type User struct {
 	allUsers       *AllUsers // AllUsers containing this user
+	attributes     attrMap   // custom attributes, the key is the name of an attribute
 	created        time.Time // time of creation
+	expires        time.Time // time the account expires, zero if it doesn't
+	failures       int       // number of consecutive failed login attempts
 	groupIds       []int     // identifiers for the groups, must be positive
-	hashedPassword string    // hashed password for the user
+	hashedPassword string    // hashed password for the user, empty if not set
+	lastFailure    time.Time // time of the last failed login attempt
+	memberOf       []int     // closure of the groups, only set for copies handed out by AllUsers
 	modified       time.Time // last modification time
+	mustChange     bool      // password must be changed on next login
 	name           string    // user's name
+	pwChanged      time.Time // time of the last password change
+	pwHistory      []string  // hashes of previous passwords, the most recent first
+	recoveryCodes  []string  // hashes of the unused recovery codes
+	scoped         bool      // copy restricted to the groups of an API key
+	status         Status    // status of the account
+	totpSecret     string    // encrypted TOTP secret, empty if not enrolled
+	totpStep       int64     // time step of the last accepted TOTP code, zero if not confirmed
 	userId         int       // identifier, must be positive
 	userName       string    // user name, must be a valid e-mail address
+	verified       bool      // user name has been verified to be the user's e-mail address
 }
 
-// Deactivate deactivates the user.
+// Deactivate deactivates the user, i.e. its status becomes StatusDisabled.
 func (u *User) Deactivate() {
-	if u.hashedPassword[:1] == "*" {
-		return
-	}
+	u.SetStatus(StatusDisabled)
+}
 
-	u.hashedPassword = "*" + u.hashedPassword
-	u.modified = time.Now()
+// clone returns a copy of u that doesn't share any data with u and doesn't
+// belong to an AllUsers instance. When u belongs to one, the copy knows the
+// groups it is a member of through nested groups. The caller must hold the
+// lock of that instance.
+func (u User) clone() *User {
+	c := u
+	c.allUsers = nil
+	c.groupIds = slices.Clone(u.groupIds)
+	c.pwHistory = slices.Clone(u.pwHistory)
+	c.recoveryCodes = slices.Clone(u.recoveryCodes)
+	c.attributes = maps.Clone(u.attributes)
+	c.memberOf = nil
+	c.scoped = false
+	if u.allUsers != nil {
+		c.memberOf = u.allUsers.effectiveGroups(u.groupIds)
+	}
+	return &c
 }
 
 // Created returns the date and time of creation.
@@ -37,22 +64,93 @@ func (u User) Created() time.Time {
 	return u.created
 }
 
+// EMailVerified returns true if the user name has been verified to be the
+// e-mail address of the user, see AllUsers.Redeem().
+func (u User) EMailVerified() bool {
+	return u.verified
+}
+
+// Expires returns the time the account expires. It is the zero time when
+// the account doesn't expire.
+func (u User) Expires() time.Time {
+	return u.expires
+}
+
+// FailedLogins returns the number of consecutive failed login attempts.
+func (u User) FailedLogins() int {
+	return u.failures
+}
+
 // GroupIds returns the group id's, a set of unique positive numbers.
 func (u User) GroupIds() []int {
 	return u.groupIds
 }
 
+// IsActive returns true if the status of the user is StatusActive.
+func (u User) IsActive() bool {
+	return u.Status() == StatusActive
+}
+
+// IsExpired returns true if the account has expired.
+func (u User) IsExpired() bool {
+	return !u.expires.IsZero() && !time.Now().Before(u.expires)
+}
+
 // IsInGroup returns true if g is is present in the set of group id's.
 func (u User) IsInGroup(g int) bool {
 	return slices.Contains(u.groupIds, g)
 }
 
+// IsMemberOf returns true if the user is a member of the group with group id
+// g, either directly or through groups contained in it. For users that
+// haven't been handed out by AllUsers, only direct memberships are known. See
+// AllUsers.AddSubGroup().
+func (u User) IsMemberOf(g int) bool {
+	if u.memberOf == nil {
+		return u.IsInGroup(g)
+	}
+	_, found := slices.BinarySearch(u.memberOf, g)
+	return found
+}
+
+// isReused returns true if plainPassword matches the current password or one
+// of the n most recent previous passwords in the history.
+func (u User) isReused(plainPassword string, n int) bool {
+	history := u.pwHistory[:min(len(u.pwHistory), n)]
+	for _, h := range append([]string{u.hashedPassword}, history...) {
+		if h != "" && compareHash(h, plainPassword) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// keepPassword adds the current password hash to the history, which is
+// truncated to n hashes.
+func (u *User) keepPassword(n int) {
+	if u.hashedPassword != "" {
+		u.pwHistory = append([]string{u.hashedPassword}, u.pwHistory...)
+	}
+	u.pwHistory = u.pwHistory[:min(len(u.pwHistory), n)]
+}
+
+// LastFailedLogin returns the time of the last failed login attempt.
+func (u User) LastFailedLogin() time.Time {
+	return u.lastFailure
+}
+
 // Modified returns the last date and time at which information was
 // modified.
 func (u User) Modified() time.Time {
 	return u.modified
 }
 
+// MustChangePassword returns true if the password must be changed on the next
+// login.
+func (u User) MustChangePassword() bool {
+	return u.mustChange
+}
+
 // Name returns the name.
 func (u User) Name() string {
 	return u.name
@@ -62,13 +160,13 @@ func (u User) Name() string {
 // Only positive and unique group id's will be accepted.
 // The user id will have a value of zero. After putting it in a AllUsers
 // struct, it will be set to a unique value.
-// User has a deactivated status.
+// User has a pending status until a password is set.
 func New(userName, name string, groupIds []int) (User, error) {
 	u := User{
-		userName:       strings.TrimSpace(userName),
-		name:           name,
-		hashedPassword: "*",
-		created:        time.Now(),
+		userName: strings.TrimSpace(userName),
+		name:     name,
+		status:   StatusPending,
+		created:  time.Now(),
 	}
 	u.modified = u.created
 	if !isValidEMailAddress(u.userName) {
@@ -79,7 +177,8 @@ func New(userName, name string, groupIds []int) (User, error) {
 }
 
 // Parse creates single User instance by parsing a string. The string must be formatted
-// accordingly to the one as returned by String().
+// accordingly to the one as returned by String(). The fields following the first 7
+// ones are optional.
 func Parse(s string) (User, error) {
 	u := User{}
 	var err error
@@ -88,7 +187,10 @@ func Parse(s string) (User, error) {
 	if l := len(fields); l < 7 {
 		return u, fmt.Errorf("%w, less than 7 fields found: %d", ErrMissingData, l)
 	}
-	fields = fields[:7]
+	fields = fields[:min(len(fields), 18)]
+
+	// the password hash is resolved together with the status
+	hash, sStatus := strings.TrimSpace(fields[1]), ""
 
 	for i, fld := range fields {
 		fld = strings.TrimSpace(fld)
@@ -99,8 +201,7 @@ func Parse(s string) (User, error) {
 				return u, fmt.Errorf("%w (%s)", err, fld)
 			}
 
-		case 1: // hashed password
-			u.hashedPassword = fld
+		case 1: // hashed password, "*" if not set
 
 		case 2: // user id
 			u.userId, err = strconv.Atoi(fld)
@@ -144,20 +245,95 @@ func Parse(s string) (User, error) {
 				return u, fmt.Errorf("%w (modification) for user %s: %w",
 					ErrInvalidTime, u.userName, err)
 			}
+
+		case 7: // number of consecutive failed login attempts
+			u.failures, err = parseCount(fld)
+			if err != nil {
+				return u, fmt.Errorf("%w (failed logins) for user %s: %q",
+					ErrInvalidField, u.userName, fld)
+			}
+
+		case 8: // time of last failed login attempt
+			u.lastFailure, err = parseOptionalTime(fld)
+			if err != nil {
+				return u, fmt.Errorf("%w (last failed login) for user %s: %w",
+					ErrInvalidTime, u.userName, err)
+			}
+
+		case 9: // status
+			sStatus = fld
+
+		case 10: // time of the last password change
+			u.pwChanged, err = parseOptionalTime(fld)
+			if err != nil {
+				return u, fmt.Errorf("%w (password change) for user %s: %w",
+					ErrInvalidTime, u.userName, err)
+			}
+
+		case 11: // flags
+			if err = u.parseFlags(fld); err != nil {
+				return u, fmt.Errorf("%w for user %s", err, u.userName)
+			}
+
+		case 12: // expiry time
+			u.expires, err = parseOptionalTime(fld)
+			if err != nil {
+				return u, fmt.Errorf("%w (expiry) for user %s: %w",
+					ErrInvalidTime, u.userName, err)
+			}
+
+		case 13: // password history
+			u.pwHistory = strings.Fields(fld)
+
+		case 14: // encrypted TOTP secret
+			u.totpSecret = fld
+
+		case 15: // time step of the last accepted TOTP code
+			step, err := parseCount(fld)
+			if err != nil {
+				return u, fmt.Errorf("%w (TOTP step) for user %s: %q",
+					ErrInvalidField, u.userName, fld)
+			}
+			u.totpStep = int64(step)
+
+		case 16: // hashes of the recovery codes
+			u.recoveryCodes = strings.Fields(fld)
+
+		case 17: // custom attributes
+			if err = u.parseAttributes(fld); err != nil {
+				return u, fmt.Errorf("%w for user %s", err, u.userName)
+			}
 		}
 	}
 
+	u.status, u.hashedPassword, err = parseStatus(sStatus, hash)
+	if err != nil {
+		return u, fmt.Errorf("%w for user %s", err, u.userName)
+	}
+
 	return u, nil
 }
 
-// Reactivate reactivates the user with the provided user name or user id.
-// can be validated again.
+// PasswordChanged returns the time of the last password change. It is the
+// zero time when it isn't known.
+func (u User) PasswordChanged() time.Time {
+	return u.pwChanged
+}
+
+// Reactivate reactivates a disabled, locked or expired user, so its password
+// can be validated again. Its status becomes StatusActive, or StatusPending
+// when no password has been set.
 func (u *User) Reactivate() {
-	if len(u.hashedPassword) == 0 || u.hashedPassword[:1] != "*" {
+	if u.status == StatusActive || u.status == StatusPending {
 		return
 	}
+	u.SetStatus(impliedStatus(u.hashedPassword))
+}
 
-	u.hashedPassword = u.hashedPassword[1:]
+// SetExpiry sets the time the account expires. The zero time means it doesn't
+// expire.
+func (u *User) SetExpiry(t time.Time) {
+	u.expires = t
 	u.modified = time.Now()
 }
 
@@ -175,7 +351,14 @@ func (u *User) SetGroups(groupIds []int) error {
 	}
 
 	slices.Sort(ids)
-	u.groupIds = ids
+	if u.allUsers != nil {
+		u.allUsers.unIndexGroups(u)
+		u.groupIds = ids
+		u.allUsers.indexGroups(u)
+	} else {
+		u.groupIds = ids
+	}
+	u.memberOf = nil // not known anymore
 	u.modified = time.Now()
 	return nil
 }
@@ -186,21 +369,50 @@ func (u *User) SetName(name string) {
 	u.modified = time.Now()
 }
 
-// SetPassword stores a hash of the plain password. If succesfull, it
-// returns nil.
+// SetPassword stores a hash of the plain password, generated by bcrypt with a
+// cost of 12. If succesfull, it returns nil.
 func (u *User) SetPassword(plainPassword string) error {
-	b, err := bcrypt.GenerateFromPassword([]byte(plainPassword), 12)
+	h, err := defaultHasher.Hash(plainPassword)
 	if err != nil {
 		return err
 	}
 
-	u.hashedPassword = string(b)
-	u.modified = time.Now()
+	u.setHashedPassword(h)
 	return nil
 }
 
+// SetMustChangePassword sets whether the password must be changed on the
+// next login.
+func (u *User) SetMustChangePassword(mustChange bool) {
+	u.mustChange = mustChange
+	u.modified = time.Now()
+}
+
+// setHashedPassword stores the hashed password h. A pending user becomes
+// active and a required password change is fulfilled.
+func (u *User) setHashedPassword(h string) {
+	u.hashedPassword = h
+	if u.status == StatusPending {
+		u.status = StatusActive
+	}
+	u.mustChange = false
+	u.modified = time.Now()
+	u.pwChanged = u.modified
+}
+
+// SetStatus sets the status of the account.
+func (u *User) SetStatus(s Status) {
+	if s == u.status {
+		return
+	}
+
+	u.status = s
+	u.modified = time.Now()
+}
+
 // SetUserName sets the user name. If the user name is not a valid e-mail
-// address ErrInvalidUserName will be returned.
+// address ErrInvalidUserName will be returned. A changed user name isn't
+// verified anymore.
 // If user is putted into AllUsers and AllUsers already has a User with than
 // user name, ErrUserExists will be returned.
 func (u *User) SetUserName(uName string) error {
@@ -221,6 +433,7 @@ func (u *User) SetUserName(uName string) error {
 		u.userName = uName
 	}
 
+	u.verified = false
 	u.modified = time.Now()
 	return nil
 }
@@ -228,11 +441,39 @@ func (u *User) SetUserName(uName string) error {
 // String returns a string with the user's information. It holds the
 // following fields separated by semi colons: user name, password hash,
 // user id, zero or more group id's separated by comma's, name, time of
-// creation and last modification time in RFC3339 format.
+// creation and last modification time in RFC3339 format. The password hash is
+// "*" when no password has been set. These fields are followed by optional
+// fields, which are only written up to the last one holding data: the number
+// of consecutive failed login attempts, the time of the last one, the status,
+// which is left empty when it's pending without a password hash or active with
+// one, the time of the last password change, zero or more flags separated by
+// comma's, the time the account expires, the hashes of previous passwords
+// separated by spaces, the encrypted TOTP secret, the time step of the last
+// accepted TOTP code, the hashes of the unused recovery codes separated by
+// spaces and the custom attributes, see attributesString().
 func (u User) String() string {
+	hash := u.hashedPassword
+	if hash == "" {
+		hash = "*"
+	}
+
 	return fmt.Sprintf("%s;%s;%d;%s;%s;%s;%s",
-		u.userName, u.hashedPassword, u.userId, intsString(u.groupIds), u.name,
-		u.created.Format(time.RFC3339), u.modified.Format(time.RFC3339))
+		u.userName, hash, u.userId, intsString(u.groupIds), u.name,
+		u.created.Format(time.RFC3339), u.modified.Format(time.RFC3339)) +
+		optionalFields(countString(u.failures), optionalTimeString(u.lastFailure),
+			statusString(u.status, u.hashedPassword), optionalTimeString(u.pwChanged),
+			u.flagsString(), optionalTimeString(u.expires), strings.Join(u.pwHistory, " "),
+			u.totpSecret, countString(int(u.totpStep)), strings.Join(u.recoveryCodes, " "),
+			u.attributesString())
+}
+
+// Status returns the status of the account. An account that has expired has
+// StatusExpired, unless it's disabled or locked.
+func (u User) Status() Status {
+	if u.IsExpired() && (u.status == StatusActive || u.status == StatusPending) {
+		return StatusExpired
+	}
+	return u.status
 }
 
 // UserId returns the user's identifier.
@@ -245,9 +486,15 @@ func (u User) UserName() string {
 	return u.userName
 }
 
-// ValidatePassword validates a password. It returns nil if the password matches.
+// ValidatePassword validates a password. It returns nil if the password matches
+// and the user is active. The algorithm used for the stored hash is detected from
+// its prefix.
 func (u User) ValidatePassword(plainPassword string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(u.hashedPassword), []byte(plainPassword))
+	if err := u.statusError(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPassword, err)
+	}
+
+	err := compareHash(u.hashedPassword, plainPassword)
 	if err != nil {
 		err = fmt.Errorf("%w: %w", ErrInvalidPassword, err)
 	}
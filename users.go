@@ -1,9 +1,16 @@
 // package users is a module to manage user data for users that can have access to a server.
 // The data are stored in a file like the password file in `*nix`.
 //
-// The following data are stored: user name, hashed password, user id, zero or more group id's, name, time of creration
-// and last time of modification. The user id, and the creation time are immutable. The modification time will change
-// when a modification of user name, password or group id's takes place.
+// The following data are stored for each user: user name, hashed password, user id, zero or more group id's, name,
+// time of creration and last time of modification. The user id, and the creation time are immutable. The modification
+// time will change when a modification of user name, password or group id's takes place. These 7 fields are followed
+// by 11 optional ones: the number of consecutive failed login attempts, the time of the last one, the status of the
+// account, the time of the last password change, flags, the time the account expires, hashes of previous passwords,
+// the encrypted TOTP secret, its last used time step, hashes of recovery codes and custom attributes.
+//
+// Groups, API keys and tokens, the latter two stored as hashes, are stored on lines following the users, as are
+// tombstones holding the user id's of removed users, so those will never be used again. Roles and their permissions
+// are stored in a policy file of their own.
 //
 // To store the data after any change they should be written to a file by calling Write().
 package users
@@ -12,77 +19,178 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"io"
+	"maps"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 )
 
 var (
-	ErrInvalidGroupId  = errors.New("invalid group id")
-	ErrInvalidPassword = errors.New("invalid password")
-	ErrInvalidUserId   = errors.New("invalid user id")
-	ErrInvalidUserName = errors.New("user name is not a valid e-mail address")
-	ErrInvalidTime     = errors.New("invalid time")
-	ErrMissingData     = errors.New("missing data")
-	ErrNoSuchUser      = errors.New("no such user")
-	ErrUserExists      = errors.New("user exists")
+	ErrAPIKeyExists             = errors.New("API key exists")
+	ErrAPIKeyExpired            = errors.New("API key has expired")
+	ErrAccountExpired           = errors.New("account has expired")
+	ErrAccountLocked            = errors.New("account is locked")
+	ErrAuthenticationFailed     = errors.New("authentication failed")
+	ErrDecryption               = errors.New("decryption failed, wrong key or tampered data")
+	ErrGroupCycle               = errors.New("groups would contain each other")
+	ErrGroupExists              = errors.New("group exists")
+	ErrGroupInUse               = errors.New("group has members")
+	ErrInvalidAPIKey            = errors.New("invalid API key")
+	ErrInvalidAttribute         = errors.New("invalid attribute")
+	ErrInvalidCode              = errors.New("invalid code")
+	ErrInvalidField             = errors.New("invalid field")
+	ErrInvalidGroupId           = errors.New("invalid group id")
+	ErrInvalidGroupName         = errors.New("invalid group name")
+	ErrInvalidPassword          = errors.New("invalid password")
+	ErrInvalidPurpose           = errors.New("invalid token purpose")
+	ErrInvalidTime              = errors.New("invalid time")
+	ErrInvalidToken             = errors.New("invalid or expired token")
+	ErrInvalidUserId            = errors.New("invalid user id")
+	ErrInvalidUserName          = errors.New("user name is not a valid e-mail address")
+	ErrMissingData              = errors.New("missing data")
+	ErrNoPassword               = errors.New("no password has been set")
+	ErrNoSecretKey              = errors.New("no secret key has been set")
+	ErrNoSuchAPIKey             = errors.New("no such API key")
+	ErrNoSuchGroup              = errors.New("no such group")
+	ErrNoSuchRole               = errors.New("no such role")
+	ErrNoSuchUser               = errors.New("no such user")
+	ErrPasswordChangeRequired   = errors.New("password must be changed")
+	ErrPasswordContainsUserData = errors.New("password contains the user name or name")
+	ErrPasswordDenied           = errors.New("password is too common")
+	ErrPasswordEmpty            = errors.New("password is empty")
+	ErrPasswordExpired          = errors.New("password has expired")
+	ErrPasswordMissingDigit     = errors.New("password has no digit")
+	ErrPasswordMissingLower     = errors.New("password has no lower case letter")
+	ErrPasswordMissingSymbol    = errors.New("password has no symbol")
+	ErrPasswordMissingUpper     = errors.New("password has no upper case letter")
+	ErrPasswordPolicy           = errors.New("password doesn't meet the policy")
+	ErrPasswordReused           = errors.New("password has been used before")
+	ErrPasswordTooLong          = errors.New("password is too long")
+	ErrPasswordTooPredictable   = errors.New("password is too predictable")
+	ErrPasswordTooShort         = errors.New("password is too short")
+	ErrSecondFactorRequired     = errors.New("second factor is required")
+	ErrTOTPEnrolled             = errors.New("TOTP enrolment has been completed already")
+	ErrTOTPNotEnrolled          = errors.New("TOTP enrolment hasn't been started or completed")
+	ErrUnknownHash              = errors.New("unknown hash algorithm")
+	ErrUserDeactivated          = errors.New("user is deactivated")
+	ErrUserExists               = errors.New("user exists")
 
 	mutex sync.Mutex // mutex for reading and writing to file
 )
 
-// AllUsers holds the data of all users for a server.
+// AllUsers holds the data of all users for a server. It is safe for concurrent
+// use: the users it hands out are copies and all modifications of the users it
+// holds must be made through its methods.
 type AllUsers struct {
-	lastId       int              // latest Id used
-	usersByEMail map[string]*User // user accounts, the key is the user name
-	usersById    map[int]*User    // user accounts, the key is the user id
+	apiKeys        map[string]APIKey // personal API keys, the key is the prefix of an API key
+	backups        int               // number of backup generations kept by Write()
+	dirty          bool              // modified since read or last written
+	dropTombstones bool              // don't write tombstones for removed users
+	dummyHash      string            // hash compared with for unknown users, empty for the default Hasher
+	groupCache     groupCache        // closures of nested groups
+	groups         map[int]*Group    // registry of groups, the key is the group id
+	hasher         Hasher            // hasher for new passwords, nil for the default
+	lastId         int               // latest Id used
+	lockout        LockoutPolicy     // policy for locking accounts after failed logins
+	maxPwAge       time.Duration     // maximum age of passwords, zero for no maximum
+	mu             sync.RWMutex      // guards all other fields
+	policy         Policy            // roles and their assignments, used by Can()
+	pwHistory      int               // number of previous passwords that can't be reused
+	pwPolicy       PasswordPolicy    // requirements for new passwords
+	removed        map[int]time.Time // tombstones, the key is the id of a removed user
+	secretKey      []byte            // key for encrypting secrets of users
+	tokens         map[string]token  // issued tokens, the key is the hash of a token
+	usersByEMail   map[string]*User  // user accounts, the key is the user name
+	usersByGroup   map[int][]*User   // members of groups sorted by user id, the key is the group id
+	usersById      map[int]*User     // user accounts, the key is the user id
+	validators     validatorMap      // validators of attributes, the key is the name of an attribute
 }
 
 // Deactivate deactivates the user with the provided user name or user id, i.e. calling
 // ValidatePassword() will fail afterwards.
 func (aU *AllUsers) Deactivate(uNameOrId interface{}) error {
-	u, found := selectUser(aU, uNameOrId)
-	if !found {
-		return ErrNoSuchUser
+	return aU.update(uNameOrId, func(u *User) error {
+		u.Deactivate()
+		return nil
+	})
+}
+
+// ExpiringWithin returns copies of the users whose accounts haven't expired yet,
+// but will do so within duration d, ordered by their expiry time.
+func (aU *AllUsers) ExpiringWithin(d time.Duration) []*User {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	now := time.Now()
+	end := now.Add(d)
+
+	expiring := []*User{}
+	for _, u := range aU.sort() {
+		if u.expires.After(now) && !u.expires.After(end) {
+			expiring = append(expiring, u.clone())
+		}
 	}
-	u.Deactivate()
 
-	return nil
+	slices.SortStableFunc(expiring, func(uA, uB *User) int {
+		return uA.expires.Compare(uB.expires)
+	})
+	return expiring
 }
 
-// Get fetches a user with the provided user name or user id.
+// Get fetches a copy of the user with the provided user name or user id.
 func (aU *AllUsers) Get(uNameOrId interface{}) (*User, error) {
-	var (
-		err   error
-		u     *User
-		found bool
-	)
-	u, found = selectUser(aU, uNameOrId)
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
 
+	u, found := selectUser(aU, uNameOrId)
 	if !found {
-		u, err = &User{}, fmt.Errorf("%w: %s", ErrNoSuchUser, uNameOrId)
+		return u, fmt.Errorf("%w: %v", ErrNoSuchUser, uNameOrId)
 	}
-	return u, err
+	return u.clone(), nil
 }
 
-// GetFunc returns a slice of users for which f returns true.
+// GetFunc returns a slice with copies of the users for which f returns true.
 func (aU *AllUsers) GetFunc(f func(u User) bool) []*User {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
 	matchingUsers := []*User{}
 
 	for _, u := range aU.usersById {
-		if f(*u) {
-			matchingUsers = append(matchingUsers, u)
+		if c := u.clone(); f(*c) {
+			matchingUsers = append(matchingUsers, c)
 		}
 	}
 
 	return matchingUsers
 }
 
+// IsDirty returns true if the user data have been modified since they were
+// read or last written.
+func (aU *AllUsers) IsDirty() bool {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	return aU.dirty
+}
+
+// KeepTombstones sets whether tombstones for removed users will be written
+// by String() and Write(). By default they are.
+func (aU *AllUsers) KeepTombstones(keep bool) {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	aU.dropTombstones = !keep
+}
+
 // ParseAll creates an AllUsers instance by parsing a string. The string must be formatted
 // as a sequence of substrings eache formatted accordingly to those as returned by String()
 // and separated by newline characters.
 func ParseAll(s string) (*AllUsers, error) {
+	defaultDummyHash()
+
 	aU := &AllUsers{}
 	if len(s) == 0 {
 		return aU, nil
@@ -94,30 +202,89 @@ func ParseAll(s string) (*AllUsers, error) {
 			return aU, err
 		}
 
-		usr, err := Parse(scanner.Text())
+		line := scanner.Text()
+		if strings.HasPrefix(line, tombstoneMark) {
+			if err := aU.parseTombstone(line); err != nil {
+				return aU, err
+			}
+			continue
+		}
+		if strings.HasPrefix(line, groupMark) {
+			if err := aU.parseGroup(line); err != nil {
+				return aU, err
+			}
+			continue
+		}
+		if strings.HasPrefix(line, apiKeyMark) {
+			if err := aU.parseAPIKey(line); err != nil {
+				return aU, err
+			}
+			continue
+		}
+		if strings.HasPrefix(line, tokenMark) {
+			if err := aU.parseToken(line); err != nil {
+				return aU, err
+			}
+			continue
+		}
+
+		usr, err := Parse(line)
 		if err != nil {
 			return aU, err
 		}
 		aU.mapUser(&usr)
 	}
 
+	for _, id := range aU.tombstones() {
+		if _, found := aU.usersById[id]; found {
+			return aU, fmt.Errorf("%w: tombstone for existing user %d", ErrInvalidUserId, id)
+		}
+	}
+
 	return aU, nil
 }
 
-// Put puts the user data into u. When an entry for the user is already present
-// an error will be returned.
+// MembersOf returns copies of the users that are in the group with group id
+// groupId, ordered by user id. Only direct members are returned, not those of
+// groups contained in the group.
+func (aU *AllUsers) MembersOf(groupId int) []*User {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	members := make([]*User, len(aU.usersByGroup[groupId]))
+	for i, u := range aU.usersByGroup[groupId] {
+		members[i] = u.clone()
+	}
+	return members
+}
+
+// Put puts a copy of the user data in u into aU and sets the user id of u to
+// the one it got in aU. The copy always gets a new user id, so the user id u
+// had is never reused. When an entry for the user is already present an error
+// will be returned. Once groups have been created by CreateGroup(), the user
+// can only be in those groups; otherwise ErrNoSuchGroup will be returned.
 func (aU *AllUsers) Put(u *User) error {
 	// test for errors:
 	if _, err := Parse(u.String()); err != nil {
 		return err
 	}
 
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
 	if _, found := selectUser(aU, u.userName); found {
 		return ErrUserExists
 	}
+	if err := aU.checkGroupIds(u.groupIds, false); err != nil {
+		return err
+	}
 
 	u.modified = time.Now()
-	aU.mapUser(u)
+	c := u.clone()
+	c.userId = 0
+	aU.mapUser(c)
+	u.userId = c.userId
+	aU.dirty = true
 
 	return nil
 }
@@ -125,86 +292,267 @@ func (aU *AllUsers) Put(u *User) error {
 // Reactivate reactivates the user with the provided user name or user id.
 // can be validated again.
 func (aU *AllUsers) Reactivate(uNameOrId interface{}) error {
-	u, found := selectUser(aU, uNameOrId)
-	if !found {
-		return ErrNoSuchUser
-	}
+	return aU.update(uNameOrId, func(u *User) error {
+		u.Reactivate()
+		return nil
+	})
+}
 
-	u.Reactivate()
-	return nil
+// Remove removes the user with the provided user name or user id. Its user id
+// will never be handed out again: a tombstone holding the id is kept and written
+// to file, unless that has been disabled by calling KeepTombstones(false).
+func (aU *AllUsers) Remove(uNameOrId interface{}) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		aU.unMapUser(u)
+		aU.dropAPIKeys(u.userId)
+		aU.dropTokens(u.userId, 0)
+		u.allUsers = nil
+
+		if aU.removed == nil {
+			aU.removed = make(map[int]time.Time)
+		}
+		aU.removed[u.userId] = time.Now()
+		return nil
+	})
 }
 
 // Read reads the user data from a file located at path. The key is used to
 // decrypt the information in the file. The key must have a length of
 // 0, 16, 24, or 32 bytes. In case the length is zero, no decrytion will take place.
 // If the file doesn't exists, an empty instance of AllUsers will be returned.
+// While reading, a shared lock on the file is held, so other processes using
+// this package can't write to it.
 func Read(path string, key []byte) (*AllUsers, error) {
-	aU := &AllUsers{}
+	return readLocked(path, keyDecoder(key))
+}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+// ReadModifyWrite reads the user data from the file at path, calls f to modify
+// them and writes them back to the file. An exclusive lock on the file is held
+// during the whole cycle, so no changes made by other processes using this
+// package can get lost. When f returns an error, nothing will be written and
+// the error will be returned. See Read() and Write() for the use of key.
+func ReadModifyWrite(path string, key []byte, f func(aU *AllUsers) error) error {
+	return modifyLocked(path, keyDecoder(key), keyEncoder(key), f)
+}
 
-	f, err := os.Open(path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			err = nil
-		}
-		return aU, err
-	}
-	defer f.Close()
+// ReadWithKeyring reads the user data from a file located at path like Read()
+// does. The key for decryption is taken from keys using the key id stored in
+// the file by WriteWithKeyId(). When the file holds no key id, every key in
+// keys will be tried. This allows servers to read a file while its key is
+// being rotated.
+func ReadWithKeyring(path string, keys Keyring) (*AllUsers, error) {
+	return readLocked(path, func(s string) (string, error) {
+		return deKeyring(s, keys)
+	})
+}
 
-	b, err := io.ReadAll(f)
-	if err != nil {
-		return aU, err
+// ReadWithPassphrase reads the user data from a file located at path like
+// Read() does. The data must have been encrypted by WriteWithPassphrase().
+// The key for decryption is derived from passphrase using the parameters
+// stored in the file.
+func ReadWithPassphrase(path string, passphrase string) (*AllUsers, error) {
+	return readLocked(path, func(s string) (string, error) {
+		return dePassphrase(s, passphrase)
+	})
+}
+
+// Rekey atomically re-encrypts the file at path, that has been encrypted with
+// oldKey, with newKey. An exclusive lock on the file is held while doing so.
+// A key with a length of zero means no encryption, see Read() and Write().
+// Unlike Read(), it returns an error when the file doesn't exist.
+func Rekey(path string, oldKey, newKey []byte) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
 	}
+	return modifyLocked(path, keyDecoder(oldKey), keyEncoder(newKey),
+		func(*AllUsers) error { return nil })
+}
 
-	s := string(b)
-	if len(key) != 0 {
-		s, err = de(s, key)
-		if err != nil {
-			return aU, err
-		}
+// RekeyWithKeyring atomically re-encrypts the file at path with the key in
+// keys having key id kid, and stores kid in the file. The file is decrypted
+// as ReadWithKeyring() does. An exclusive lock on the file is held while
+// doing so. Like Rekey(), it returns an error when the file doesn't exist.
+func RekeyWithKeyring(path string, keys Keyring, kid string) error {
+	key, found := keys[kid]
+	if !found {
+		return fmt.Errorf("no key with key id %q", kid)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
 	}
 
-	return ParseAll(s)
+	return modifyLocked(path,
+		func(s string) (string, error) { return deKeyring(s, keys) },
+		func(s string) (string, error) { return enKeyId(s, kid, key) },
+		func(*AllUsers) error { return nil })
 }
 
-// String writes the user data in a string.
-func (aU *AllUsers) String() (string, error) {
-	sortedUsers := aU.sort()
+// SetBackups sets the number of generations of previous contents Write()
+// keeps as numbered backups. The backups are stored in files with the
+// generation number appended to the path, e.g. "users.txt.1" holds the
+// most recent one. By default no backups are kept.
+func (aU *AllUsers) SetBackups(n int) {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
 
-	var b strings.Builder
-	for _, usr := range sortedUsers {
-		if _, err := b.WriteString(usr.String() + "\n"); err != nil {
-			return "", err
-		}
-	}
-	return b.String(), nil
+	aU.backups = max(n, 0)
 }
 
-// Write stores the user data in a file.
-func (aU *AllUsers) Write(path string, key []byte) error {
-	s, err := aU.String()
-	if err != nil {
-		return err
-	}
+// SetExpiry sets the time the account of the user with the provided user name
+// or user id expires. The zero time means it doesn't expire.
+func (aU *AllUsers) SetExpiry(uNameOrId interface{}, t time.Time) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		u.SetExpiry(t)
+		return nil
+	})
+}
 
-	if len(key) != 0 {
-		s, err = en(s, key)
-		if err != nil {
+// SetGroups sets the group id's of the user with the provided user name or
+// user id. See User.SetGroups(). Once groups have been created by
+// CreateGroup(), only their group id's are accepted; otherwise ErrNoSuchGroup
+// will be returned.
+func (aU *AllUsers) SetGroups(uNameOrId interface{}, groupIds []int) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		if err := aU.checkGroupIds(groupIds, false); err != nil {
 			return err
 		}
+		return u.SetGroups(groupIds)
+	})
+}
+
+// SetMustChangePassword sets whether the user with the provided user name or
+// user id must change its password on the next login. See Authenticate().
+func (aU *AllUsers) SetMustChangePassword(uNameOrId interface{}, mustChange bool) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		u.SetMustChangePassword(mustChange)
+		return nil
+	})
+}
+
+// SetName sets the name of the user with the provided user name or user id.
+func (aU *AllUsers) SetName(uNameOrId interface{}, name string) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		u.SetName(name)
+		return nil
+	})
+}
+
+// SetHasher sets the Hasher used for hashing new passwords. By default
+// BcryptHasher{Cost: 12} is used. Existing hashes will still be validated
+// using the algorithm they have been generated with. As a dummy hash for
+// Authenticate() is generated with h, it takes as long as hashing a password.
+func (aU *AllUsers) SetHasher(h Hasher) {
+	// generate it now, so Authenticate() doesn't have to
+	dummyHash := ""
+	if h != nil {
+		dummyHash = newDummyHash(h)
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	aU.hasher = h
+	aU.dummyHash = dummyHash
+}
+
+// SetPassword stores a hash of the plain password for the user with the
+// provided user name or user id. The hash is generated by the Hasher set by
+// SetHasher(). A password that doesn't meet the policy set by
+// SetPasswordPolicy() is refused with a *PolicyError. When a password history
+// is kept, see SetPasswordHistory(), the current password and the previous
+// ones in the history are refused with ErrPasswordReused.
+func (aU *AllUsers) SetPassword(uNameOrId interface{}, plainPassword string) error {
+	aU.mu.RLock()
+	u, found := selectUser(aU, uNameOrId)
+	user := *u.clone()
+	aU.mu.RUnlock()
 
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if !found {
+		return ErrNoSuchUser
+	}
+
+	h, n, err := aU.hashNewPassword(user, plainPassword)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	_, err = f.WriteString(s)
-	return err
+	return aU.update(uNameOrId, func(u *User) error {
+		u.keepPassword(n)
+		u.setHashedPassword(h)
+		return nil
+	})
+}
+
+// SetPasswordHistory sets the number of previous passwords that are kept for
+// each user and can't be used again by SetPassword(). A value of zero, the
+// default, means no history is kept. Histories that are longer are truncated
+// when the password of the user is set again; only their n most recent
+// passwords are refused.
+func (aU *AllUsers) SetPasswordHistory(n int) {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	aU.pwHistory = max(n, 0)
+}
+
+// SetPasswordPolicy sets the policy new passwords must meet. The zero value,
+// the default, only refuses empty passwords.
+// The denylist of p is copied, so passwords loaded into p afterwards aren't
+// refused.
+func (aU *AllUsers) SetPasswordPolicy(p PasswordPolicy) {
+	aU.mu.Lock()
+	defer aU.mu.Unlock()
+
+	p.denylist = maps.Clone(p.denylist)
+	aU.pwPolicy = p
+}
+
+// SetUserName sets the user name of the user with the provided user name or
+// user id. See User.SetUserName().
+func (aU *AllUsers) SetUserName(uNameOrId interface{}, uName string) error {
+	return aU.update(uNameOrId, func(u *User) error {
+		return u.SetUserName(uName)
+	})
+}
+
+// String writes the user data in a string. Tombstones for removed users
+// follow the users.
+func (aU *AllUsers) String() (string, error) {
+	aU.mu.RLock()
+	defer aU.mu.RUnlock()
+
+	return aU.string()
+}
+
+// Write stores the user data in a file. The key is used to encrypt the
+// information in the file. The key must have a length of 0, 16, 24, or 32
+// bytes. In case the length is zero, no encryption will take place.
+// The file is replaced atomically: it always holds either the previous or the
+// new data. While writing, an exclusive lock on the file is held, so other
+// processes using this package can't access it.
+func (aU *AllUsers) Write(path string, key []byte) error {
+	return aU.writeLocked(path, keyEncoder(key))
+}
+
+// WriteWithKeyId stores the user data in a file like Write() does, encrypted
+// with key. The key id kid is stored in the file, so ReadWithKeyring() can
+// find the key for decryption. A key id must not be empty or hold a "$".
+func (aU *AllUsers) WriteWithKeyId(path string, kid string, key []byte) error {
+	return aU.writeLocked(path, func(s string) (string, error) {
+		return enKeyId(s, kid, key)
+	})
+}
+
+// WriteWithPassphrase stores the user data in a file like Write() does. The
+// key for encryption is derived from passphrase using scrypt with a random
+// salt. The salt and the scrypt parameters are stored in the file, so the
+// passphrase is all ReadWithPassphrase() needs.
+func (aU *AllUsers) WriteWithPassphrase(path string, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("passphrase is empty")
+	}
+
+	return aU.writeLocked(path, func(s string) (string, error) {
+		return enPassphrase(s, passphrase)
+	})
 }
@@ -2,9 +2,11 @@ package users
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -180,6 +182,14 @@ func TestParse(t *testing.T) {
 			"d@e.f;$2a$12$cKlDQ9UmKhy7XS40fXR8jONaajOX3k1g1YfN63lsa0OxjgxcMpKA6;2;1;A;2023-11-24xx16:25:00Z;2023-12-05T08:14:00Z",
 			ErrInvalidTime,
 		},
+		{
+			"d@e.f;$2a$12$cKlDQ9UmKhy7XS40fXR8jONaajOX3k1g1YfN63lsa0OxjgxcMpKA6;2;1;A;2023-11-24T16:25:00Z;2023-12-05T08:14:00Z;2;2023-12-06T10:00:00Z",
+			nil,
+		},
+		{
+			"d@e.f;$2a$12$cKlDQ9UmKhy7XS40fXR8jONaajOX3k1g1YfN63lsa0OxjgxcMpKA6;2;1;A;2023-11-24T16:25:00Z;2023-12-05T08:14:00Z;-2",
+			ErrInvalidField,
+		},
 	}
 
 	for _, tst := range tests {
@@ -273,10 +283,15 @@ func TestActivate(t *testing.T) {
 			}
 		} else {
 			sU, _ := aU.Get(tst.selector)
-			want := "*$x$x$xxxxxx"
-			if sU.hashedPassword != want {
-				t.Errorf("Deactivate(%v) returns %q; should be %q",
-					tst.selector, sU.hashedPassword, want)
+			if got := sU.Status(); got != StatusDisabled {
+				t.Errorf("Deactivate(%v) sets status %s; should be %s",
+					tst.selector, got, StatusDisabled)
+			}
+			want := "a@b.c;$x$x$xxxxxx;1;1;A;2023-11-24T15:38:00Z;"
+			if got := sU.String(); !strings.HasPrefix(got, want) ||
+				!strings.HasSuffix(got, ";;;disabled") {
+				t.Errorf("Deactivate(%v) results in %q; should be %q...;;;disabled",
+					tst.selector, got, want)
 			}
 		}
 
@@ -288,6 +303,10 @@ func TestActivate(t *testing.T) {
 			}
 		} else {
 			sU, _ := aU.Get(tst.selector)
+			if got := sU.Status(); got != StatusActive {
+				t.Errorf("Reactivate(%v) sets status %s; should be %s",
+					tst.selector, got, StatusActive)
+			}
 			want := "$x$x$xxxxxx"
 			if sU.hashedPassword != want {
 				t.Errorf("Reactivate(%v) returns %q; should be %q",
@@ -297,6 +316,69 @@ func TestActivate(t *testing.T) {
 	}
 }
 
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		s      string
+		status Status
+		hash   string
+		want   string
+		err    error
+	}{
+		{"a@b.c;*;1;;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z",
+			StatusPending, "", "", nil},
+		{"a@b.c;$x$x;1;;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z",
+			StatusActive, "$x$x", "", nil},
+		{"a@b.c;*$x$x;1;;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z",
+			StatusDisabled, "$x$x", "a@b.c;$x$x;1;;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;;;disabled", nil},
+		{"a@b.c;*;1;;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;;;disabled",
+			StatusDisabled, "", "", nil},
+		{"a@b.c;$x$x;1;;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;;;locked",
+			StatusLocked, "$x$x", "", nil},
+		{"a@b.c;$x$x;1;;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;;;expired",
+			StatusExpired, "$x$x", "", nil},
+		{"a@b.c;$x$x;1;;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;;;active",
+			StatusActive, "$x$x", "a@b.c;$x$x;1;;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z", nil},
+		{"a@b.c;$x$x;1;;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z;;;gone",
+			StatusPending, "", "", ErrInvalidField},
+	}
+
+	for _, tst := range tests {
+		u, err := Parse(tst.s)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil {
+			if len(sE1) > 0 {
+				t.Errorf("Parse(%q) returns error %q, should be %q", tst.s, sE1, sE2)
+			}
+			continue
+		}
+
+		if got := u.Status(); got != tst.status {
+			t.Errorf("Parse(%q) results in status %s, should be %s", tst.s, got, tst.status)
+		}
+		if u.hashedPassword != tst.hash {
+			t.Errorf("Parse(%q) results in hash %q, should be %q", tst.s, u.hashedPassword, tst.hash)
+		}
+
+		want := tst.want
+		if want == "" {
+			want = tst.s
+		}
+		if got := u.String(); got != want {
+			t.Errorf("String() returns\n%q,\nshould be\n%q", got, want)
+		}
+	}
+
+	u, err := New("a@b.c", "A", []int{})
+	if err != nil {
+		t.Fatalf("New() returns an error: %s", err.Error())
+	}
+	u.Deactivate()
+	u.Reactivate()
+	if got := u.Status(); got != StatusPending {
+		t.Errorf("Reactivate() without a password sets status %s, should be %s",
+			got, StatusPending)
+	}
+}
+
 func TestGet(t *testing.T) {
 	s := `a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z`
 	aU, err := ParseAll(s)
@@ -343,11 +425,23 @@ d@e.f;*;2;1;A;2023-11-24T16:25:00Z;2023-12-05T08:14:00Z
 		t.Fatalf("Get() returns an error: %s", err.Error())
 	}
 
-	err = user.SetUserName("e@b.c")
+	// user is a copy, changing it should leave aU untouched
+	if err = user.SetUserName("x@b.c"); err != nil {
+		t.Fatalf("SetUserName() returns an error: %s", err.Error())
+	}
+	if _, err = aU.Get("x@b.c"); !errors.Is(err, ErrNoSuchUser) {
+		t.Fatalf("Get() returns error %v, should be: %s", err, ErrNoSuchUser)
+	}
+
+	err = aU.SetUserName("a@b.c", "e@b.c")
 	if err != nil {
 		t.Fatalf("SetUserName() returns an error: %s", err.Error())
 	}
 
+	if err = aU.SetUserName(2, "e@b.c"); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("SetUserName() returns error %v, should be: %s", err, ErrUserExists)
+	}
+
 	_, err = aU.Get("a@b.c")
 	if err == nil {
 		t.Fatalf("Get() returns no error, should be: %s",
@@ -412,6 +506,27 @@ func TestPutGetAndUserId(t *testing.T) {
 			}
 		}
 	}
+
+	// putting the same User again under another user name adds a new user
+	u := User{userName: "h@b.c", name: "h"}
+	if err := aU.Put(&u); err != nil {
+		t.Fatalf("Put(%q) returns an error: %s", u.userName, err.Error())
+	}
+	first := u.UserId()
+	if err := u.SetUserName("i@b.c"); err != nil {
+		t.Fatalf("SetUserName() returns an error: %s", err.Error())
+	}
+	if err := aU.Put(&u); err != nil {
+		t.Fatalf("Put(%q) returns an error: %s", u.userName, err.Error())
+	}
+	if id := u.UserId(); id == first {
+		t.Errorf("Put() reuses user id %d", id)
+	}
+	for _, uName := range []string{"h@b.c", "i@b.c"} {
+		if _, err := aU.Get(uName); err != nil {
+			t.Errorf("Get(%q) returns an error: %s", uName, err.Error())
+		}
+	}
 }
 
 func TestGetFunc(t *testing.T) {
@@ -446,6 +561,137 @@ c@b.c;*;2;1,2;C;2023-11-24T16:25:00Z;2023-12-05T08:14:00Z
 	}
 }
 
+func TestRemove(t *testing.T) {
+	s := `a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z
+b@b.c;*;2;2;B;2023-11-24T16:25:00Z;2023-12-05T08:14:00Z
+`
+	aU, err := ParseAll(s)
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	tests := []struct {
+		selector interface{}
+		err      error
+	}{
+		{2, nil},
+		{"b@b.c", ErrNoSuchUser},
+		{3, ErrNoSuchUser},
+	}
+
+	for _, tst := range tests {
+		err := aU.Remove(tst.selector)
+		if notBothAreNil, sE1, sE2 := testErrs(err, tst.err); notBothAreNil {
+			if len(sE1) > 0 {
+				t.Errorf("Remove(%v) returns an error: %s, should be: %s",
+					tst.selector, sE1, sE2)
+			}
+		} else if _, err := aU.Get(tst.selector); !errors.Is(err, ErrNoSuchUser) {
+			t.Errorf("Get(%v) after Remove() returns error %v, should be %s",
+				tst.selector, err, ErrNoSuchUser)
+		}
+	}
+
+	sAll, err := aU.String()
+	if err != nil {
+		t.Fatalf("String() returns an error: %s", err.Error())
+	}
+
+	for _, keep := range []bool{true, false} {
+		aU2, err := ParseAll(sAll)
+		if err != nil {
+			t.Fatalf("ParseAll() returns an error: %s", err.Error())
+		}
+		aU2.KeepTombstones(keep)
+
+		s2, err := aU2.String()
+		if err != nil {
+			t.Fatalf("String() returns an error: %s", err.Error())
+		}
+		if got := strings.Contains(s2, "\n-;2;"); got != keep {
+			t.Errorf("String() with KeepTombstones(%t) has a tombstone: %t", keep, got)
+		}
+
+		u, err := New("c@b.c", "C", []int{})
+		if err != nil {
+			t.Fatalf("New() returns an error: %s", err.Error())
+		}
+		if err = aU2.Put(&u); err != nil {
+			t.Fatalf("Put() returns an error: %s", err.Error())
+		}
+		if usr, _ := aU2.Get("c@b.c"); usr.UserId() != 3 {
+			t.Errorf("UserId() returns %d, should be 3", usr.UserId())
+		}
+	}
+
+	// a user holding the id of a removed user doesn't revive it
+	u, err := Parse("d@b.c;*;2;2;D;2023-11-24T16:25:00Z;2023-12-05T08:14:00Z")
+	if err != nil {
+		t.Fatalf("Parse() returns an error: %s", err.Error())
+	}
+	if err = aU.Put(&u); err != nil {
+		t.Fatalf("Put() returns an error: %s", err.Error())
+	}
+	if id := u.UserId(); id == 2 {
+		t.Errorf("Put() revives removed user id %d", id)
+	}
+	if _, err := aU.Get(2); !errors.Is(err, ErrNoSuchUser) {
+		t.Errorf("Get(2) after Put() returns error %v, should be %s", err, ErrNoSuchUser)
+	}
+
+	// a tombstone for a user that is present
+	if _, err := ParseAll(s + "-;2;2023-12-06T10:00:00Z\n"); !errors.Is(err, ErrInvalidUserId) {
+		t.Errorf("ParseAll() with a tombstone for user 2 returns error %v, should be %s",
+			err, ErrInvalidUserId)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	s := `a@b.c;*;1;1;A;2023-11-24T15:38:00Z;2023-12-05T08:14:00Z
+b@b.c;*;2;2;B;2023-11-24T16:25:00Z;2023-12-05T08:14:00Z
+`
+	aU, err := ParseAll(s)
+	if err != nil {
+		t.Fatalf("ParseAll() returns an error: %s", err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			u, err := New(fmt.Sprintf("u%d@b.c", i), "U", []int{i})
+			if err != nil {
+				t.Errorf("New() returns an error: %s", err.Error())
+				return
+			}
+			if err := aU.Put(&u); err != nil {
+				t.Errorf("Put() returns an error: %s", err.Error())
+			}
+
+			for j := 0; j < 20; j++ {
+				aU.SetName(1, fmt.Sprintf("A%d", j))
+				aU.SetGroups(2, []int{i, j})
+				aU.Deactivate(u.UserId())
+				if usr, err := aU.Get(1); err == nil {
+					usr.SetName("changed")
+				}
+				aU.GetFunc(func(u User) bool { return u.IsInGroup(j) })
+				aU.String()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if l := len(aU.GetFunc(func(User) bool { return true })); l != 12 {
+		t.Errorf("GetFunc() returns %d users, should be 12", l)
+	}
+	if u, _ := aU.Get(1); u.Name() != "A19" {
+		t.Errorf("Name() returns %q, should be %q", u.Name(), "A19")
+	}
+}
+
 func TestReadAndWrite(t *testing.T) {
 	users := []User{
 		{